@@ -0,0 +1,74 @@
+package easyssh
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithm presets for SSHConfig.Algorithms.
+const (
+	// AlgorithmsModern restricts the connection to curve25519 key exchange, chacha20-poly1305 encryption
+	// and ed25519 or ecdsa host keys.
+	AlgorithmsModern = "modern"
+	// AlgorithmsCompat adds legacy algorithms to the defaults, such as diffie-hellman-group1-sha1,
+	// diffie-hellman-group-exchange, aes128-cbc and 3des-cbc, for old servers and network devices.
+	AlgorithmsCompat = "compat"
+)
+
+type algorithms struct {
+	ciphers, keyExchanges, macs, hostKeyAlgorithms []string
+}
+
+var algorithmPresets = map[string]algorithms{
+	AlgorithmsModern: {
+		ciphers:      []string{"chacha20-poly1305@openssh.com"},
+		keyExchanges: []string{"curve25519-sha256@libssh.org"},
+		macs:         []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+		hostKeyAlgorithms: []string{
+			ssh.CertAlgoED25519v01, ssh.KeyAlgoED25519,
+			ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		},
+	},
+	AlgorithmsCompat: {
+		ciphers: []string{
+			"aes128-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+			"aes128-ctr", "aes192-ctr", "aes256-ctr",
+			"aes128-cbc", "3des-cbc",
+		},
+		keyExchanges: []string{
+			"curve25519-sha256@libssh.org",
+			"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+			"diffie-hellman-group-exchange-sha256", "diffie-hellman-group14-sha1",
+			"diffie-hellman-group-exchange-sha1", "diffie-hellman-group1-sha1",
+		},
+		macs: []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96"},
+	},
+}
+
+// setAlgorithms restricts config to the algorithms of sshConf, the lists it leaves empty are
+// taken from the Algorithms preset, then from the ssh package defaults.
+func (sshConf *SSHConfig) setAlgorithms(config *ssh.ClientConfig) error {
+	preset := algorithms{}
+	if sshConf.Algorithms != "" {
+		var ok bool
+		if preset, ok = algorithmPresets[sshConf.Algorithms]; !ok {
+			return fmt.Errorf("unknown algorithms preset: %s", sshConf.Algorithms)
+		}
+	}
+	config.Ciphers = firstNonEmpty(sshConf.Ciphers, preset.ciphers)
+	config.KeyExchanges = firstNonEmpty(sshConf.KeyExchanges, preset.keyExchanges)
+	config.MACs = firstNonEmpty(sshConf.MACs, preset.macs)
+	config.HostKeyAlgorithms = firstNonEmpty(sshConf.HostKeyAlgorithms, preset.hostKeyAlgorithms)
+	return nil
+}
+
+func firstNonEmpty(lists ...[]string) []string {
+	for _, list := range lists {
+		if len(list) > 0 {
+			return list
+		}
+	}
+	return nil
+}
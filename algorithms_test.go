@@ -0,0 +1,87 @@
+package easyssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// handshake runs an ssh handshake between a client configured by sshConf and a server offering
+// only the given algorithms.
+func handshake(t *testing.T, sshConf *SSHConfig, server ssh.Config) error {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{Config: server, NoClientAuth: true}
+	serverConfig.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		serverConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		_, _, _, _ = ssh.NewServerConn(serverConn, serverConfig)
+	}()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	config := &ssh.ClientConfig{User: "john", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	if err := sshConf.setAlgorithms(config); err != nil {
+		return err
+	}
+	c, _, _, err := ssh.NewClientConn(clientConn, "switch:22", config)
+	if err == nil {
+		_ = c.Close()
+	}
+	return err
+}
+
+func TestAlgorithms(t *testing.T) {
+	legacy := ssh.Config{KeyExchanges: []string{"diffie-hellman-group1-sha1"}, Ciphers: []string{"aes128-cbc"}}
+	if err := handshake(t, &SSHConfig{}, legacy); err == nil {
+		t.Error("legacy algorithms should not be negotiated by default")
+	}
+	if err := handshake(t, &SSHConfig{Algorithms: AlgorithmsCompat}, legacy); err != nil {
+		t.Errorf("compat preset: %s", err)
+	}
+	if err := handshake(t, &SSHConfig{KeyExchanges: []string{"diffie-hellman-group1-sha1"}, Ciphers: []string{"aes128-cbc"}}, legacy); err != nil {
+		t.Errorf("explicit algorithms: %s", err)
+	}
+
+	modern := ssh.Config{KeyExchanges: []string{"curve25519-sha256@libssh.org"}, Ciphers: []string{"chacha20-poly1305@openssh.com"}}
+	if err := handshake(t, &SSHConfig{Algorithms: AlgorithmsModern}, modern); err != nil {
+		t.Errorf("modern preset: %s", err)
+	}
+	if err := handshake(t, &SSHConfig{Algorithms: AlgorithmsModern}, ssh.Config{Ciphers: []string{"aes128-ctr"}}); err == nil {
+		t.Error("modern preset should refuse aes128-ctr")
+	}
+
+	config := &ssh.ClientConfig{}
+	if err := (&SSHConfig{Algorithms: AlgorithmsModern, Ciphers: []string{"aes256-ctr"}}).setAlgorithms(config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Ciphers, []string{"aes256-ctr"}) || !reflect.DeepEqual(config.KeyExchanges, []string{"curve25519-sha256@libssh.org"}) {
+		t.Errorf("explicit lists should override the preset: %v %v", config.Ciphers, config.KeyExchanges)
+	}
+	if err := (&SSHConfig{Algorithms: "fast"}).setAlgorithms(config); err == nil {
+		t.Error("unknown preset should fail")
+	}
+}
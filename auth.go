@@ -0,0 +1,244 @@
+package easyssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gaols/goutils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// authMethods returns the auth methods made of the credentials of sshConf,
+// the returned func releases the resources they hold once the handshake is over.
+func (sshConf *SSHConfig) authMethods() ([]ssh.AuthMethod, func(), error) {
+	// auths holds the detected ssh auth methods
+	authMethods := make([]ssh.AuthMethod, 0)
+	closer := func() {}
+
+	// figure out what auths are requested, what is supported
+	if sshConf.Password != "" {
+		authMethods = append(authMethods, ssh.Password(sshConf.Password))
+	}
+
+	signers, err := sshConf.signers()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(signers) > 0 {
+		authMethods = append(authMethods, ssh.PublicKeys(signers...))
+	}
+
+	switch {
+	case sshConf.DisableAgent:
+	case sshConf.Agent != nil:
+		authMethods = append(authMethods, ssh.PublicKeysCallback(sshConf.Agent.Signers))
+	default:
+		// the agent is only needed during the handshake, forwarding dials it again for every request.
+		if sshAgent, err := net.Dial("unix", sshConf.agentSocket()); err == nil {
+			authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+			closer = func() {
+				_ = sshAgent.Close()
+			}
+		}
+	}
+
+	if sshConf.KeyboardInteractive != nil || (sshConf.KeyboardInteractivePassword && sshConf.Password != "") {
+		authMethods = append(authMethods, ssh.KeyboardInteractive(sshConf.keyboardInteractive))
+	}
+	return authMethods, closer, nil
+}
+
+// agentSocket returns the path of the agent socket, empty if the agent is disabled.
+func (sshConf *SSHConfig) agentSocket() string {
+	if sshConf.DisableAgent {
+		return ""
+	}
+	return goutils.DefaultIfBlank(sshConf.AgentSocket, os.Getenv("SSH_AUTH_SOCK"))
+}
+
+// forwardAgent serves the agent forwarding requests of the server.
+func (sshConf *SSHConfig) forwardAgent(client *ssh.Client) error {
+	if sshConf.DisableAgent {
+		return errors.New("cannot forward disabled agent")
+	}
+	if sshConf.Agent != nil {
+		return agent.ForwardToAgent(client, sshConf.Agent)
+	}
+	socket := sshConf.agentSocket()
+	if socket == "" {
+		return errors.New("cannot forward agent: SSH_AUTH_SOCK is not set")
+	}
+	return agent.ForwardToRemote(client, socket)
+}
+
+// keyboardInteractive answers the password prompts from Password if KeyboardInteractivePassword is set,
+// the other questions are passed to KeyboardInteractive.
+func (sshConf *SSHConfig) keyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if !sshConf.KeyboardInteractivePassword {
+		return sshConf.KeyboardInteractive(name, instruction, questions, echos)
+	}
+
+	answers := make([]string, len(questions))
+	var others []int // indexes of the questions left to KeyboardInteractive
+	for i, question := range questions {
+		if !echos[i] && isPasswordPrompt(question) {
+			answers[i] = sshConf.Password
+		} else {
+			others = append(others, i)
+		}
+	}
+	if len(others) == 0 {
+		return answers, nil
+	}
+	if sshConf.KeyboardInteractive == nil {
+		return nil, fmt.Errorf("unexpected keyboard-interactive question: %s", strings.TrimSpace(questions[others[0]]))
+	}
+
+	otherQuestions := make([]string, len(others))
+	otherEchos := make([]bool, len(others))
+	for j, i := range others {
+		otherQuestions[j], otherEchos[j] = questions[i], echos[i]
+	}
+	otherAnswers, err := sshConf.KeyboardInteractive(name, instruction, otherQuestions, otherEchos)
+	if err != nil {
+		return nil, err
+	}
+	if len(otherAnswers) != len(others) {
+		return nil, fmt.Errorf("keyboard-interactive: %d answers for %d questions", len(otherAnswers), len(others))
+	}
+	for j, i := range others {
+		answers[i] = otherAnswers[j]
+	}
+	return answers, nil
+}
+
+// isPasswordPrompt tells whether a keyboard-interactive question asks for the password,
+// like "Password: " or "john@example.com's password:".
+func isPasswordPrompt(question string) bool {
+	return strings.Contains(strings.ToLower(question), "password")
+}
+
+// signers loads all the private keys of sshConf, failing if any of them cannot be used.
+// Keys which have a certificate are offered with the certificate first, then alone.
+func (sshConf *SSHConfig) signers() ([]ssh.Signer, error) {
+	signers := append([]ssh.Signer{}, sshConf.Signers...)
+	certs := append([]*ssh.Certificate{}, sshConf.Certificates...)
+
+	keyFiles := sshConf.Keys
+	if goutils.IsNotBlank(sshConf.Key) {
+		keyFiles = append([]string{sshConf.Key}, keyFiles...)
+	}
+	for _, keyFile := range keyFiles {
+		signer, err := sshConf.getKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+
+		// like OpenSSH, use the certificate lying next to the key.
+		certFile := keyFile + "-cert.pub"
+		if IsFileExists(certFile) {
+			cert, err := loadCertificate(certFile)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+
+	for i, key := range sshConf.PrivateKeys {
+		signer, err := sshConf.parsePrivateKey(fmt.Sprintf("#%d", i), key)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	return certSigners(certs, signers)
+}
+
+// certSigners pairs every certificate with the signer of its key.
+func certSigners(certs []*ssh.Certificate, signers []ssh.Signer) ([]ssh.Signer, error) {
+	if len(certs) == 0 {
+		return signers, nil
+	}
+	result := make([]ssh.Signer, 0, len(certs)+len(signers))
+	for _, cert := range certs {
+		var signer ssh.Signer
+		for _, s := range signers {
+			if bytes.Equal(s.PublicKey().Marshal(), cert.Key.Marshal()) {
+				signer = s
+				break
+			}
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("no private key for certificate %s (%s)", cert.KeyId, ssh.FingerprintSHA256(cert.Key))
+		}
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %s error: %w", cert.KeyId, err)
+		}
+		result = append(result, certSigner)
+	}
+	return append(result, signers...), nil
+}
+
+// loadCertificate reads an OpenSSH certificate, as found in the *-cert.pub files.
+func loadCertificate(certPath string) (*ssh.Certificate, error) {
+	buf, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("read certificate %s error: %w", certPath, err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate %s error: %w", certPath, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", certPath)
+	}
+	return cert, nil
+}
+
+// returns ssh.Signer from user you running app home path + cutted key path.
+// (ex. pubkey,err := getKeyFile("/.ssh/id_rsa") )
+func (sshConf *SSHConfig) getKeyFile(keyPath string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read private key %s error: %w", keyPath, err)
+	}
+	return sshConf.parsePrivateKey(keyPath, buf)
+}
+
+// parsePrivateKey parses a PEM or OpenSSH private key, decrypting it if needed.
+// name identifies the key in errors and in the calls to PassphraseCallback.
+func (sshConf *SSHConfig) parsePrivateKey(name string, buf []byte) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey(buf)
+	if _, encrypted := err.(*ssh.PassphraseMissingError); !encrypted {
+		if err != nil {
+			return nil, fmt.Errorf("parse private key %s error: %w", name, err)
+		}
+		return signer, nil
+	}
+
+	passphrase := sshConf.Passphrase
+	if passphrase == "" && sshConf.PassphraseCallback != nil {
+		if passphrase, err = sshConf.PassphraseCallback(name); err != nil {
+			return nil, fmt.Errorf("get passphrase of private key %s error: %w", name, err)
+		}
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("private key %s is encrypted but no passphrase is provided", name)
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(buf, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt private key %s error: %w", name, err)
+	}
+	return signer, nil
+}
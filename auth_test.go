@@ -0,0 +1,128 @@
+package easyssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newTestEncryptedKey(t *testing.T, passphrase string) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte(passphrase), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block)
+}
+
+func TestSigners(t *testing.T) {
+	key := newTestEncryptedKey(t, "secret")
+
+	signers, err := (&SSHConfig{PrivateKeys: [][]byte{key}, Passphrase: "secret"}).signers()
+	if err != nil || len(signers) != 1 {
+		t.Fatalf("decrypt with passphrase: %d signers, %v", len(signers), err)
+	}
+
+	asked := ""
+	sshConf := &SSHConfig{PrivateKeys: [][]byte{key}, PassphraseCallback: func(name string) (string, error) {
+		asked = name
+		return "secret", nil
+	}}
+	if _, err := sshConf.signers(); err != nil || asked != "#0" {
+		t.Errorf("decrypt with callback: asked for %q, %v", asked, err)
+	}
+
+	if _, err := (&SSHConfig{PrivateKeys: [][]byte{key}}).signers(); err == nil || !strings.Contains(err.Error(), "no passphrase") {
+		t.Errorf("expected missing passphrase error, got %v", err)
+	}
+	if _, err := (&SSHConfig{PrivateKeys: [][]byte{key}, Passphrase: "wrong"}).signers(); err == nil {
+		t.Error("wrong passphrase accepted")
+	}
+	if _, err := (&SSHConfig{Key: "/nonexistent/id_rsa"}).signers(); err == nil {
+		t.Error("missing key file should fail")
+	}
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	sshConf := &SSHConfig{Password: "secret", KeyboardInteractivePassword: true}
+	answers, err := sshConf.keyboardInteractive("", "", []string{"Password: "}, []bool{false})
+	if err != nil || len(answers) != 1 || answers[0] != "secret" {
+		t.Fatalf("password prompt: %v %v", answers, err)
+	}
+	if _, err := sshConf.keyboardInteractive("", "", []string{"Verification code: "}, []bool{true}); err == nil {
+		t.Error("unexpected question should fail without KeyboardInteractive")
+	}
+
+	sshConf.KeyboardInteractive = func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) != 1 || questions[0] != "Verification code: " {
+			t.Errorf("unexpected questions: %q", questions)
+		}
+		return []string{"123456"}, nil
+	}
+	answers, err = sshConf.keyboardInteractive("", "", []string{"Verification code: ", "Password: "}, []bool{true, false})
+	if err != nil || len(answers) != 2 || answers[0] != "123456" || answers[1] != "secret" {
+		t.Errorf("mixed prompts: %v %v", answers, err)
+	}
+}
+
+func TestCertSigners(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{Key: signer.PublicKey(), CertType: ssh.UserCert, KeyId: "john", ValidBefore: ssh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+
+	signers, err := (&SSHConfig{Signers: []ssh.Signer{signer}, Certificates: []*ssh.Certificate{cert}}).signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 || signers[0].PublicKey().Type() != cert.Type() || signers[1] != signer {
+		t.Errorf("expected the certificate signer first, then the key")
+	}
+
+	if _, err := (&SSHConfig{Certificates: []*ssh.Certificate{cert}}).signers(); err == nil {
+		t.Error("certificate without private key should fail")
+	}
+}
+
+func TestAuthMethodsAgent(t *testing.T) {
+	keyring := agent.NewKeyring().(agent.ExtendedAgent)
+	for _, c := range []struct {
+		sshConf *SSHConfig
+		methods int
+	}{
+		{&SSHConfig{Agent: keyring}, 1},
+		{&SSHConfig{Agent: keyring, DisableAgent: true}, 0},
+		{&SSHConfig{AgentSocket: "/nonexistent/agent.sock"}, 0},
+	} {
+		methods, closer, err := c.sshConf.authMethods()
+		if err != nil {
+			t.Fatal(err)
+		}
+		closer()
+		if len(methods) != c.methods {
+			t.Errorf("expected %d auth methods, got %d", c.methods, len(methods))
+		}
+	}
+
+	if err := (&SSHConfig{DisableAgent: true}).forwardAgent(nil); err == nil {
+		t.Error("disabled agent should not be forwarded")
+	}
+}
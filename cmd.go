@@ -0,0 +1,126 @@
+package easyssh
+
+import (
+	"strings"
+)
+
+// Cmd builds a shell command line from argv-style arguments, which are quoted for a POSIX shell,
+// so that paths with spaces or shell characters are passed as they are:
+//
+//	easyssh.Command("tar", "czf", "-", dir).Pipe("gzip", "-t").And("echo", "ok").String()
+//
+// Commands are chained from left to right, like the shell does with a | b && c.
+type Cmd struct {
+	b strings.Builder
+}
+
+// Command returns a Cmd running name with args.
+func Command(name string, args ...string) *Cmd {
+	c := &Cmd{}
+	c.command(name, args)
+	return c
+}
+
+// Arg appends arguments to the last command.
+func (c *Cmd) Arg(args ...string) *Cmd {
+	for _, arg := range args {
+		c.b.WriteByte(' ')
+		c.b.WriteString(Quote(arg))
+	}
+	return c
+}
+
+// Pipe pipes the output of the command line into name with args.
+func (c *Cmd) Pipe(name string, args ...string) *Cmd {
+	return c.op(" | ", name, args)
+}
+
+// And runs name with args if the command line succeeds.
+func (c *Cmd) And(name string, args ...string) *Cmd {
+	return c.op(" && ", name, args)
+}
+
+// Or runs name with args if the command line fails.
+func (c *Cmd) Or(name string, args ...string) *Cmd {
+	return c.op(" || ", name, args)
+}
+
+// Then runs name with args once the command line is over, whether it succeeds or not.
+func (c *Cmd) Then(name string, args ...string) *Cmd {
+	return c.op("; ", name, args)
+}
+
+// From redirects the input of the last command from the file at path.
+func (c *Cmd) From(path string) *Cmd {
+	return c.redirect(" < ", path)
+}
+
+// To redirects the output of the last command to the file at path, which is truncated.
+func (c *Cmd) To(path string) *Cmd {
+	return c.redirect(" > ", path)
+}
+
+// AppendTo appends the output of the last command to the file at path.
+func (c *Cmd) AppendTo(path string) *Cmd {
+	return c.redirect(" >> ", path)
+}
+
+// ErrTo redirects the error output of the last command to the file at path, which is truncated.
+func (c *Cmd) ErrTo(path string) *Cmd {
+	return c.redirect(" 2> ", path)
+}
+
+// ErrToOut redirects the error output of the last command to its output.
+func (c *Cmd) ErrToOut() *Cmd {
+	c.b.WriteString(" 2>&1")
+	return c
+}
+
+// String returns the command line.
+func (c *Cmd) String() string {
+	return c.b.String()
+}
+
+func (c *Cmd) op(op, name string, args []string) *Cmd {
+	c.b.WriteString(op)
+	c.command(name, args)
+	return c
+}
+
+func (c *Cmd) command(name string, args []string) {
+	// a name like FOO=bar would be taken for an assignment.
+	if strings.Contains(name, "=") {
+		c.b.WriteString(shellQuote(name))
+	} else {
+		c.b.WriteString(Quote(name))
+	}
+	c.Arg(args...)
+}
+
+func (c *Cmd) redirect(op, path string) *Cmd {
+	c.b.WriteString(op)
+	c.b.WriteString(Quote(path))
+	return c
+}
+
+// Quote quotes s for a POSIX shell, s is left as it is if it has no special character.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for _, r := range s {
+		if !isSafeShellRune(r) {
+			return shellQuote(s)
+		}
+	}
+	return s
+}
+
+func isSafeShellRune(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r)
+}
+
+// shellQuote always quotes s in single quotes.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,59 @@
+package easyssh
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := map[string]string{
+		"":                 "''",
+		"/tmp/app-1.0.tgz": "/tmp/app-1.0.tgz",
+		"my dir":           "'my dir'",
+		"a;rm -rf /":       "'a;rm -rf /'",
+		"it's":             `'it'\''s'`,
+		"$HOME":            "'$HOME'",
+	}
+	for s, want := range tests {
+		if got := Quote(s); got != want {
+			t.Errorf("Quote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestCmd(t *testing.T) {
+	tests := []struct {
+		cmd  *Cmd
+		want string
+	}{
+		{Command("cd", "/srv/my app").And("tar", "xf", "a b.tgz"), `cd '/srv/my app' && tar xf 'a b.tgz'`},
+		{Command("cat", "x").Pipe("grep", "-v", "#").To("out;1").ErrToOut(), `cat x | grep -v '#' > 'out;1' 2>&1`},
+		{Command("sort").From("in").AppendTo("out").ErrTo("err").Or("true").Then("echo", "done"), `sort < in >> out 2> err || true; echo done`},
+		{Command("A=b", "c"), `'A=b' c`},
+		{Command("echo").Arg("", "*"), `echo '' '*'`},
+	}
+	for _, test := range tests {
+		if got := test.cmd.String(); got != test.want {
+			t.Errorf("got %s, want %s", got, test.want)
+		}
+	}
+}
+
+func TestCmdShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	args := []string{"plain", "with space", "semi;colon", "it's", `"$HOME"`, "`id`", "new\nline", ""}
+	cmd := Command("printf", "%s|").Arg(args...)
+	out, err := exec.Command("sh", "-c", cmd.String()).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ""
+	for _, arg := range args {
+		want += arg + "|"
+	}
+	if string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
@@ -6,9 +6,9 @@ package easyssh
 
 import (
 	"bufio"
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"golang.org/x/crypto/ssh/agent"
 	"io"
 	"io/ioutil"
 	"log"
@@ -16,11 +16,13 @@ import (
 	"strings"
 
 	"os"
+	"sync"
 	"time"
 
 	"github.com/gaols/goutils"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 const (
@@ -30,11 +32,22 @@ const (
 	TypeStderr = 1
 )
 
+// defaultKillGracePeriod is how long a timed out command is given to exit after each signal.
+const defaultKillGracePeriod = 5 * time.Second
+
+// defaultMaxSessions is the number of sessions open at once on a connection, like MaxSessions of OpenSSH.
+const defaultMaxSessions = 10
+
+// defaultKeepAliveMaxMissed is the default number of keepalive intervals without answer, like ServerAliveCountMax.
+const defaultKeepAliveMaxMissed = 3
+
 // SSHConfig contains main authority information.
 // User field should be a name of user on remote server (ex. john in ssh john@example.com).
 // Server field should be a remote machine address (ex. example.com in ssh john@example.com)
 // Key is a path to private key on your local machine.
 // Port is SSH server port on remote machine.
+// All commands and transfers share one connection which is opened on first use, call Close to release it.
+// An SSHConfig must not be copied after first use.
 type SSHConfig struct {
 	User     string
 	Server   string
@@ -42,113 +55,524 @@ type SSHConfig struct {
 	Port     string
 	Password string
 	Timeout  int
+
+	// Keys, PrivateKeys and Signers give more private keys, as paths, PEM or OpenSSH encoded bytes and signers.
+	// A key which cannot be loaded makes the connection fail.
+	Keys        []string
+	PrivateKeys [][]byte
+	Signers     []ssh.Signer
+	// Passphrase decrypts the encrypted keys, if it is empty PassphraseCallback is asked for the passphrase
+	// of each encrypted key, which it is given the path of, or "#index" for PrivateKeys.
+	Passphrase         string
+	PassphraseCallback func(key string) (string, error)
+	// Certificates are OpenSSH user certificates, each is used with the private key it certifies.
+	// The certificate of a key file is also loaded from the -cert.pub file next to it, like id_rsa-cert.pub.
+	Certificates []*ssh.Certificate
+
+	// KeyboardInteractive answers the keyboard-interactive challenges, like one-time codes.
+	// With KeyboardInteractivePassword the password prompts are answered from Password
+	// and only the other questions are passed to KeyboardInteractive.
+	KeyboardInteractive         ssh.KeyboardInteractiveChallenge
+	KeyboardInteractivePassword bool
+
+	// Agent is the ssh agent used to authenticate, if it is nil the agent listening on AgentSocket is used,
+	// $SSH_AUTH_SOCK by default. DisableAgent turns the agent off.
+	Agent        agent.ExtendedAgent
+	AgentSocket  string
+	DisableAgent bool
+	// ForwardAgent forwards the agent to the sessions, so that remote commands like git clone can use it.
+	// Pooled connections forward the agent only if the SSHConfig which dialed them does.
+	ForwardAgent bool
+
+	// KnownHosts lists the OpenSSH known_hosts files the server key is verified against,
+	// ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts are used if it is empty.
+	KnownHosts []string
+	// HostKeyPolicy selects how host keys are verified, with HostKeyTOFU the keys of new servers
+	// are appended to the first KnownHosts file.
+	HostKeyPolicy HostKeyPolicy
+	// HostCAs are trusted to sign host certificates, in addition to the @cert-authority
+	// entries of the known_hosts files. The @revoked entries still apply to their certificates.
+	HostCAs []ssh.PublicKey
+
+	// MaxSessions bounds the sessions open at once on the shared connection, the commands and transfers
+	// beyond it wait for one of them to end. It defaults to 10, the MaxSessions default of OpenSSH,
+	// a server allowing fewer sessions rejects the others. A Pool has its own limit.
+	MaxSessions int
+
+	// Pool, if set, provides the connection instead, it is shared with the other SSHConfig values
+	// using the same pool and user@host:port.
+	Pool *Pool
+
+	// JumpHosts are the bastions the server is reached through, in order, each with its own
+	// credentials. The server is connected to with direct-tcpip channels, like ssh -J does.
+	JumpHosts []*SSHConfig
+	// DialContext opens the connection to the server, like through a proxy with ProxyFromURL or
+	// ProxyFromEnvironment, it is dialed directly if DialContext is nil. With JumpHosts, the
+	// DialContext of the first jump host is used instead.
+	DialContext DialContextFunc
+
+	// KeepAliveInterval, if set, makes the connection send a keepalive@openssh.com request to the server
+	// every interval, along with TCP keepalives. The connection is closed if the server does not answer
+	// within KeepAliveMaxMissed more intervals, 3 by default, and the commands and transfers using it
+	// fail with ErrKeepAliveTimeout.
+	KeepAliveInterval  time.Duration
+	KeepAliveMaxMissed int
+
+	// Ciphers, KeyExchanges, MACs and HostKeyAlgorithms restrict the algorithms negotiated with the server.
+	// Algorithms names a preset, AlgorithmsModern or AlgorithmsCompat, used for the lists left empty,
+	// the ssh package defaults are used otherwise.
+	Algorithms        string
+	Ciphers           []string
+	KeyExchanges      []string
+	MACs              []string
+	HostKeyAlgorithms []string
+
+	// Retry, if set, retries dialing, uploads, downloads and idempotent commands after transient failures.
+	Retry *RetryPolicy
+
+	// SudoPassword answers the password prompt of Sudo. If it is empty SudoPasswordCallback is called
+	// the first time sudo asks, and Password is used if there is no callback either.
+	SudoPassword         string
+	SudoPasswordCallback func() (string, error)
+
+	// TimeoutSignal is sent to commands which time out or whose context is done, SIGTERM by default.
+	// SIGKILL follows if they are still running after KillGracePeriod, 5 seconds by default, along with
+	// the close of their session. A command still running after another KillGracePeriod is given up,
+	// so the call returns at most 2*KillGracePeriod after the timeout, the output it writes later is dropped.
+	TimeoutSignal   ssh.Signal
+	KillGracePeriod time.Duration
+
+	mu       sync.Mutex
+	conn     *ssh.Client
+	dialing  *sharedDial   // the dial of conn in progress, if any
+	sessions chan struct{} // one token per session open on conn
 }
 
-// returns ssh.Signer from user you running app home path + cutted key path.
-// (ex. pubkey,err := getKeyFile("/.ssh/id_rsa") )
-func getKeyFile(keyPath string) (ssh.Signer, error) {
-	buf, err := ioutil.ReadFile(keyPath)
-	if err != nil {
-		return nil, err
+// sharedDial is a dial of the shared connection, which the other callers wait for.
+type sharedDial struct {
+	ready  chan struct{} // closed once the dial is over
+	client *ssh.Client
+	err    error
+}
+
+// remoteSession is a session opened by connect.
+type remoteSession struct {
+	*ssh.Session
+	once     sync.Once
+	closeFn  func() error // closes the session
+	closeErr error
+	lostErr  func() error // returns ErrKeepAliveTimeout once the connection is lost for lack of keepalive answers
+}
+
+func newRemoteSession(client *ssh.Client, session *ssh.Session, closeFn func() error) *remoteSession {
+	return &remoteSession{Session: session, closeFn: closeFn, lostErr: keepAliveErr(client)}
+}
+
+// release closes the session and returns the error of the close, it may be called more than once.
+func (rs *remoteSession) release() error {
+	rs.once.Do(func() { rs.closeErr = rs.closeFn() })
+	return rs.closeErr
+}
+
+// opens a new session on the shared connection, the connection is dialed again
+// if the server has dropped it since it was last used.
+func (sshConf *SSHConfig) connect(ctx context.Context) (*remoteSession, error) {
+	session, err := sshConf.openSession(ctx)
+	if err != nil || !sshConf.ForwardAgent {
+		return session, err
+	}
+	if err = agent.RequestAgentForwarding(session.Session); err != nil {
+		session.release()
+		return nil, fmt.Errorf("request agent forwarding error: %w", err)
 	}
+	return session, nil
+}
 
-	pubKey, err := ssh.ParsePrivateKey(buf)
-	if err != nil {
-		return nil, err
+func (sshConf *SSHConfig) openSession(ctx context.Context) (*remoteSession, error) {
+	if sshConf.Pool != nil {
+		return sshConf.Pool.session(ctx, sshConf)
 	}
 
-	return pubKey, nil
-}
+	slots := sshConf.sessionSlots()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-slots }
 
-// connects to remote server using SSHConfig struct and returns *ssh.Session
-func (sshConf *SSHConfig) connect() (*ssh.Session, error) {
-	client, err := sshConf.Cli()
+	client, err := sshConf.client(ctx)
 	if err != nil {
+		release()
 		return nil, err
 	}
-
 	session, err := client.NewSession()
+	// a session refused by the server, like beyond its MaxSessions, says nothing about the
+	// connection and the sessions running on it.
+	var openErr *ssh.OpenChannelError
+	if err != nil && !errors.As(err, &openErr) {
+		sshConf.discard(client)
+		if client, err = sshConf.client(ctx); err == nil {
+			session, err = client.NewSession()
+		}
+	}
 	if err != nil {
+		release()
 		return nil, err
 	}
-	return session, nil
+	return newRemoteSession(client, session, func() error {
+		err := closeSession(session)
+		release()
+		return err
+	}), nil
 }
 
-// Cli create ssh client
-func (sshConf *SSHConfig) Cli() (*ssh.Client, error) {
-	// auths holds the detected ssh auth methods
-	authMethods := make([]ssh.AuthMethod, 0)
-
-	// figure out what auths are requested, what is supported
-	if sshConf.Password != "" {
-		authMethods = append(authMethods, ssh.Password(sshConf.Password))
+// sessionSlots returns the semaphore bounding the sessions open on the shared connection.
+func (sshConf *SSHConfig) sessionSlots() chan struct{} {
+	sshConf.mu.Lock()
+	defer sshConf.mu.Unlock()
+	if sshConf.sessions == nil {
+		maxSessions := sshConf.MaxSessions
+		if maxSessions <= 0 {
+			maxSessions = defaultMaxSessions
+		}
+		sshConf.sessions = make(chan struct{}, maxSessions)
 	}
+	return sshConf.sessions
+}
 
-	if goutils.IsNotBlank(sshConf.Key) {
-		if pubKey, err := getKeyFile(sshConf.Key); err == nil {
-			authMethods = append(authMethods, ssh.PublicKeys(pubKey))
+// closeOnDone calls release as soon as ctx is done, which aborts whatever runs on the session.
+// The returned func stops watching ctx.
+func closeOnDone(ctx context.Context, release func()) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			release()
+		case <-stop:
 		}
-	}
+	}()
+	return func() { close(stop) }
+}
 
-	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
-		defer func() {
-			_ = sshAgent.Close()
-		}()
-	}
+// userAndAddr returns the login user and the host:port address of the server.
+func (sshConf *SSHConfig) userAndAddr() (string, string) {
 	// Default port 22
-	sshConf.Port = goutils.DefaultIfBlank(sshConf.Port, "22")
+	port := goutils.DefaultIfBlank(sshConf.Port, "22")
 
 	// Default current user
-	sshConf.User = goutils.DefaultIfBlank(sshConf.User, os.Getenv("USER"))
+	user := goutils.DefaultIfBlank(sshConf.User, os.Getenv("USER"))
 
-	config := &ssh.ClientConfig{
-		User:            sshConf.User,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	return user, net.JoinHostPort(sshConf.host(), port)
+}
+
+// closeSession closes session, a session already closed by the server is not an error.
+func closeSession(session *ssh.Session) error {
+	if err := session.Close(); err != nil && err != io.EOF {
+		return err
 	}
+	return nil
+}
 
-	// default maximum amount of time for the TCP connection to establish is 10s
-	config.Timeout = time.Second * 30
-	if sshConf.Timeout > 0 {
-		config.Timeout = time.Duration(sshConf.Timeout) * time.Second
+// Client returns the connection shared by all the methods of sshConf, dialing it if needed.
+// The returned client is owned by sshConf or its Pool and should not be closed by the caller, use Close instead.
+func (sshConf *SSHConfig) Client() (*ssh.Client, error) {
+	return sshConf.client(context.Background())
+}
+
+func (sshConf *SSHConfig) client(ctx context.Context) (*ssh.Client, error) {
+	if sshConf.Pool != nil {
+		return sshConf.Pool.client(ctx, sshConf)
 	}
 
-	return ssh.Dial("tcp", sshConf.Server+":"+sshConf.Port, config)
+	for {
+		sshConf.mu.Lock()
+		if client := sshConf.conn; client != nil {
+			sshConf.mu.Unlock()
+			return client, nil
+		}
+		d, waiting := sshConf.dialing, sshConf.dialing != nil
+		if !waiting {
+			d = &sharedDial{ready: make(chan struct{})}
+			sshConf.dialing = d
+		}
+		sshConf.mu.Unlock()
+		if !waiting {
+			sshConf.dialShared(ctx, d)
+		}
+
+		// the callers waiting for the dial of another one give up as soon as their ctx is done.
+		select {
+		case <-d.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if d.err != nil {
+			// the dial was aborted by the context of the caller which started it, dial again.
+			if waiting && ctx.Err() == nil && (d.err == context.Canceled || d.err == context.DeadlineExceeded) {
+				continue
+			}
+			return nil, d.err
+		}
+		return d.client, nil
+	}
 }
 
-func loopReader(reader io.Reader, outCh chan string, doneCh chan byte) {
+// dialShared dials the shared connection for d.
+func (sshConf *SSHConfig) dialShared(ctx context.Context, d *sharedDial) {
+	client, err := sshConf.CliContext(ctx)
+	sshConf.mu.Lock()
+	sshConf.dialing = nil
+	if err == nil {
+		sshConf.conn = client
+	}
+	d.client, d.err = client, err
+	close(d.ready)
+	sshConf.mu.Unlock()
+	if err != nil {
+		return
+	}
 	go func() {
-		scanner := bufio.NewScanner(reader)
-		for scanner.Scan() {
-			outCh <- scanner.Text()
+		// forget the connection as soon as it is lost, the next call will dial again.
+		_ = client.Wait()
+		sshConf.discard(client)
+	}()
+}
+
+// discard closes client and forgets it if it is still the shared connection.
+func (sshConf *SSHConfig) discard(client *ssh.Client) {
+	sshConf.mu.Lock()
+	if sshConf.conn == client {
+		sshConf.conn = nil
+	}
+	sshConf.mu.Unlock()
+	_ = client.Close()
+}
+
+// Close closes the shared connection, it will be opened again if sshConf is used afterwards.
+// Pooled connections are left open, they are closed by the Pool.
+func (sshConf *SSHConfig) Close() error {
+	sshConf.mu.Lock()
+	client := sshConf.conn
+	sshConf.conn = nil
+	sshConf.mu.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+// Cli dials a new ssh client which is not shared with the other methods, the caller should close it.
+func (sshConf *SSHConfig) Cli() (*ssh.Client, error) {
+	return sshConf.CliContext(context.Background())
+}
+
+// CliContext is like Cli, dialing and handshake are aborted when ctx is done.
+func (sshConf *SSHConfig) CliContext(ctx context.Context) (*ssh.Client, error) {
+	var client *ssh.Client
+	err := sshConf.retry(ctx, func(ctx context.Context) (err error) {
+		client, err = sshConf.dial(ctx)
+		return err
+	})
+	return client, err
+}
+
+// dial connects to the server, through the jump hosts if any.
+func (sshConf *SSHConfig) dial(ctx context.Context) (*ssh.Client, error) {
+	_, addr := sshConf.userAndAddr()
+	if len(sshConf.JumpHosts) == 0 {
+		dial := sshConf.DialContext
+		if dial == nil {
+			// the TCP keepalives follow the ssh ones, the net package default is used otherwise.
+			dial = (&net.Dialer{KeepAlive: sshConf.KeepAliveInterval}).DialContext
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, sshConf.dialTimeout())
+		conn, err := dial(dialCtx, "tcp", addr)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		return sshConf.newClient(ctx, conn, addr)
+	}
+
+	// like ProxyJump, every jump host is reached through the previous one, the first one is dialed
+	// as usual. The jump clients belong to the returned client and are closed along with it.
+	jumps := make([]*ssh.Client, 0, len(sshConf.JumpHosts))
+	closeJumps := func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			_ = jumps[i].Close()
+		}
+	}
+	jump, err := sshConf.JumpHosts[0].CliContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	jumps = append(jumps, jump)
+
+	hops := append(append([]*SSHConfig{}, sshConf.JumpHosts[1:]...), sshConf)
+	var client *ssh.Client
+	for _, hop := range hops {
+		_, hopAddr := hop.userAndAddr()
+		prev := jumps[len(jumps)-1]
+		stop := closeOnDone(ctx, func() { _ = prev.Close() })
+		conn, err := prev.Dial("tcp", hopAddr)
+		stop()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			closeJumps()
+			return nil, fmt.Errorf("jump to %s error: %w", hopAddr, err)
+		}
+		if client, err = hop.newClient(ctx, conn, hopAddr); err != nil {
+			closeJumps()
+			return nil, err
 		}
-		doneCh <- 1
+		if hop != sshConf {
+			jumps = append(jumps, client)
+		}
+	}
+
+	go func() {
+		_ = client.Wait()
+		closeJumps()
 	}()
+	return client, nil
 }
 
-// Stream returns one channel that combines the stdout and stderr of the command
-// as it is run on the remote machine, and another that sends true when the
-// command is done. The sessions and channels will then be closed.
-func (sshConf *SSHConfig) Stream(command string, timeout int) (stdout, stderr chan string, done chan bool, err error) {
-	stdout = make(chan string)
-	stderr = make(chan string)
-	done = make(chan bool)
-	// connect to remote host
-	session, err := sshConf.connect()
+// dialTimeout is the maximum amount of time for the TCP connection to establish, 30s by default.
+func (sshConf *SSHConfig) dialTimeout() time.Duration {
+	if sshConf.Timeout > 0 {
+		return time.Duration(sshConf.Timeout) * time.Second
+	}
+	return time.Second * 30
+}
+
+// newClient runs the ssh handshake with the server at addr over conn, which is closed on failure.
+func (sshConf *SSHConfig) newClient(ctx context.Context, conn net.Conn, addr string) (*ssh.Client, error) {
+	authMethods, closeAuth, err := sshConf.authMethods()
 	if err != nil {
-		return
+		_ = conn.Close()
+		return nil, err
 	}
-	// connect to both outputs (they are of type io.Reader)
-	stdOutReader, err := session.StdoutPipe()
+	defer closeAuth()
+
+	hostKeyCallback, err := sshConf.hostKeyCallback()
 	if err != nil {
-		return
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// ssh.NewClientConn flattens the callback error into a string, keep it to return it typed.
+	var hostKeyErr error
+	user, _ := sshConf.userAndAddr()
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: authMethods,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = hostKeyCallback(hostname, remote, key)
+			return hostKeyErr
+		},
+		Timeout: sshConf.dialTimeout(),
+	}
+	if err = sshConf.setAlgorithms(config); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	var kaConn *keepAliveConn
+	if sshConf.KeepAliveInterval > 0 {
+		kaConn = newKeepAliveConn(conn)
+		conn = kaConn
+	}
+
+	stop := closeOnDone(ctx, func() { _ = conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	stop()
+	if ctx.Err() != nil {
+		_ = conn.Close()
+		return nil, ctx.Err()
+	}
+	if hostKeyErr != nil {
+		_ = conn.Close()
+		return nil, hostKeyErr
 	}
-	stderrReader, err := session.StderrPipe()
 	if err != nil {
-		return
+		_ = conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	if kaConn != nil {
+		maxMissed := sshConf.KeepAliveMaxMissed
+		if maxMissed <= 0 {
+			maxMissed = defaultKeepAliveMaxMissed
+		}
+		keepAliveConns.Store(client, kaConn)
+		go kaConn.keepAlive(client, sshConf.KeepAliveInterval, maxMissed)
+	}
+	if sshConf.ForwardAgent {
+		if err = sshConf.forwardAgent(client); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
 	}
-	err = session.Start(command)
+	return client, nil
+}
+
+// Stream returns one channel that combines the stdout and stderr of the command
+// as it is run on the remote machine, and another that sends true when the
+// command is done, or false if it failed: it exited with a non zero status, was
+// killed by a signal or timed out, the timeout is also reported on stderr.
+// The sessions and channels will then be closed.
+func (sshConf *SSHConfig) Stream(command string, timeout int) (stdout, stderr chan string, done chan bool, err error) {
+	return sshConf.streamDone(context.Background(), command, &RunOptions{Timeout: seconds(timeout)})
+}
+
+// StreamContext is like Stream without timeout, if ctx is done before the command
+// the session is closed and false is sent on done.
+func (sshConf *SSHConfig) StreamContext(ctx context.Context, command string) (stdout, stderr chan string, done chan bool, err error) {
+	return sshConf.streamDone(ctx, command, nil)
+}
+
+// StreamWithOptions is like StreamContext, the command is run with opts which may be nil.
+// The Stdout and Stderr of opts are not used. Once the command is over done receives
+// nil, or the error Exec would return, like an *ExitError if it failed or ctx.Err().
+func (sshConf *SSHConfig) StreamWithOptions(ctx context.Context, command string, opts *RunOptions) (stdout, stderr chan string, done chan error, err error) {
+	done = make(chan error)
+	stdout, stderr, err = sshConf.stream(ctx, command, opts, func(stderr chan<- string, result *Result, waitErr error) {
+		done <- waitErr
+		close(done)
+	})
+	return
+}
+
+func (sshConf *SSHConfig) streamDone(ctx context.Context, command string, opts *RunOptions) (stdout, stderr chan string, done chan bool, err error) {
+	done = make(chan bool)
+	stdout, stderr, err = sshConf.stream(ctx, command, opts, func(stderr chan<- string, result *Result, waitErr error) {
+		if result.TimedOut && ctx.Err() == nil {
+			stderr <- timeoutMessage(command)
+		}
+		done <- waitErr == nil
+		close(done)
+	})
+	return
+}
+
+// stream sends the output lines of command on stdout and stderr, and calls finish once it is over,
+// before they are closed.
+func (sshConf *SSHConfig) stream(ctx context.Context, command string, opts *RunOptions, finish func(stderr chan<- string, result *Result, err error)) (stdout, stderr chan string, err error) {
+	stdout = make(chan string)
+	stderr = make(chan string)
+	p, err := sshConf.startLines(ctx, command, opts, func(line string, lineType int) {
+		if lineType == TypeStdout {
+			stdout <- line
+		} else {
+			stderr <- line
+		}
+	})
 	if err != nil {
 		return
 	}
@@ -157,94 +581,91 @@ func (sshConf *SSHConfig) Stream(command string, timeout int) (stdout, stderr ch
 	go func() {
 		defer close(stdout)
 		defer close(stderr)
-		defer close(done)
-
-		go func() {
-			stdoutDone := make(chan byte)
-			stderrDone := make(chan byte)
-			// loop stdout
-			loopReader(stdOutReader, stdout, stdoutDone)
-			// loop stderr
-			loopReader(stderrReader, stderr, stderrDone)
-			<-stdoutDone
-			<-stderrDone
-			done <- true
-		}()
 
-		if timeout <= 0 {
-			timeout = 24 * 3600 // a long timeout simulate wait forever
-		}
-		timeoutChan := time.After(time.Duration(timeout) * time.Second)
-		select {
-		case r := <-done:
-			done <- r
-		case <-timeoutChan:
-			stderr <- fmt.Sprintf("Run command timeout: %s", command)
-			done <- false
-		}
+		result, err := p.wait()
+		finish(stderr, result, err)
 	}()
 
 	return
 }
 
-// Run command on remote machine and returns its stdout as a string
+func timeoutMessage(command string) string {
+	return fmt.Sprintf("Run command timeout: %s", command)
+}
+
+// seconds converts the integer second timeouts of the API, zero or less means no timeout.
+func seconds(timeout int) time.Duration {
+	if timeout <= 0 {
+		return 0
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// Run command on remote machine and returns its stdout as a string.
+// A command exiting with a non zero status is reported as an *ExitError.
 func (sshConf *SSHConfig) Run(command string, timeout int) (outStr, errStr string, isTimeout bool, err error) {
-	stdoutChan, stderrChan, doneChan, err := sshConf.Stream(command, timeout)
-	if err != nil {
+	result, err := sshConf.Exec(context.Background(), command, &RunOptions{Timeout: seconds(timeout)})
+	if result == nil {
 		return outStr, errStr, isTimeout, err
 	}
-	// read from the output channel until the done signal is passed
-	var stdoutBuf, stderrBuf bytes.Buffer
+	if result.TimedOut {
+		// the timeout is reported through isTimeout and on stderr
+		return result.Stdout, result.Stderr + timeoutMessage(command) + "\n", true, nil
+	}
+	return result.Stdout, result.Stderr, false, err
+}
 
-OuterL:
-	for {
-		select {
-		case done := <-doneChan:
-			isTimeout = !done
-			break OuterL
-		case outLine := <-stdoutChan:
-			stdoutBuf.WriteString(outLine + "\n")
-		case errLine := <-stderrChan:
-			stderrBuf.WriteString(errLine + "\n")
-		}
+// RunContext is like Run without timeout, ctx.Err() is returned if ctx is done before the command.
+func (sshConf *SSHConfig) RunContext(ctx context.Context, command string) (outStr, errStr string, err error) {
+	result, err := sshConf.Exec(ctx, command, nil)
+	if result == nil {
+		return outStr, errStr, err
 	}
-	// return the concatenation of all signals from the output channel
-	return stdoutBuf.String(), stderrBuf.String(), isTimeout, err
+	return result.Stdout, result.Stderr, err
 }
 
 // RtRun run command on remote machine and get command output as soon as possible.
+// A command exiting with a non zero status is reported as an *ExitError.
 func (sshConf *SSHConfig) RtRun(command string, lineHandler func(string string, lineType int), timeout int) (isTimeout bool, err error) {
-	stdoutChan, stderrChan, doneChan, err := sshConf.Stream(command, timeout)
-	if err != nil {
-		return isTimeout, err
-	}
-	// read from the output channel until the done signal is passed
-OuterL:
-	for {
-		select {
-		case done := <-doneChan:
-			isTimeout = !done
-			break OuterL
-		case outLine := <-stdoutChan:
-			lineHandler(outLine, TypeStdout)
-		case errLine := <-stderrChan:
-			lineHandler(errLine, TypeStderr)
-		}
+	result, err := sshConf.execute(context.Background(), command, &RunOptions{Timeout: seconds(timeout)}, lineHandler)
+	if result != nil && result.TimedOut {
+		lineHandler(timeoutMessage(command), TypeStderr)
+		return true, nil
 	}
-	// return the concatenation of all signals from the output channel
-	return isTimeout, err
+	return false, err
+}
+
+// RtRunContext is like RtRun without timeout, ctx.Err() is returned if ctx is done before the command.
+func (sshConf *SSHConfig) RtRunContext(ctx context.Context, command string, lineHandler func(line string, lineType int)) error {
+	_, err := sshConf.execute(ctx, command, nil, lineHandler)
+	return err
+}
+
+// RtRunWithOptions is like RtRunContext, the command is run with opts which may be nil, like with
+// ForwardSignals set to interrupt it on Ctrl-C. The Stdout and Stderr of opts are not used.
+func (sshConf *SSHConfig) RtRunWithOptions(ctx context.Context, command string, lineHandler func(line string, lineType int), opts *RunOptions) (*Result, error) {
+	return sshConf.execute(ctx, command, opts, lineHandler)
 }
 
 // Scp uploads localPath to remotePath like native scp console app.
 // Warning: remotePath should contain the file name if the localPath is a regular file,
 // however, if the localPath to copy is dir, the remotePath must be the dir into which the localPath will be copied.
 func (sshConf *SSHConfig) Scp(localPath, remotePath string) error {
+	return sshConf.ScpContext(context.Background(), localPath, remotePath)
+}
+
+// ScpContext is like Scp, the transfer is aborted and ctx.Err() returned when ctx is done.
+func (sshConf *SSHConfig) ScpContext(ctx context.Context, localPath, remotePath string) error {
+	return sshConf.scp(ctx, localPath, remotePath, true)
+}
+
+func (sshConf *SSHConfig) scp(ctx context.Context, localPath, remotePath string, verbose bool) error {
 	if goutils.IsDir(localPath) {
-		return sshConf.SCopyDir(localPath, remotePath, -1, true)
+		return sshConf.SCopyDirContext(ctx, localPath, remotePath, verbose)
 	}
 
 	if goutils.IsRegular(localPath) {
-		return sshConf.SCopyFile(localPath, remotePath)
+		return sshConf.SCopyFileContext(ctx, localPath, remotePath)
 	}
 
 	panic("invalid local path: " + localPath)
@@ -257,7 +678,12 @@ func (sshConf *SSHConfig) ScpM(dirPathMappings map[string]string) error {
 
 // RunScript run a serial of commands on remote
 func (sshConf *SSHConfig) RunScript(script string) error {
-	return sshConf.Work(func(s *ssh.Session) error {
+	return sshConf.RunScriptContext(context.Background(), script)
+}
+
+// RunScriptContext is like RunScript, the remote shell is closed and ctx.Err() returned when ctx is done.
+func (sshConf *SSHConfig) RunScriptContext(ctx context.Context, script string) error {
+	return sshConf.WorkContext(ctx, func(s *ssh.Session) error {
 		s.Stdin = bufio.NewReader(strings.NewReader(script))
 		stdout, err := s.StdoutPipe()
 		if err != nil {
@@ -1,8 +1,18 @@
 package easyssh
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 var sshConfig = &SSHConfig{
@@ -82,3 +92,245 @@ func TestSSHConfig_RunScript(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// gatedReader returns its data once gate is closed.
+type gatedReader struct {
+	gate <-chan struct{}
+	data io.Reader
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	<-r.gate
+	return r.data.Read(p)
+}
+
+func TestSSHConfig_MaxSessions(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	s.maxSessions = 10
+	sshConf := s.sshConfig()
+	defer sshConf.Close()
+
+	// 30 commands at once on a server allowing 10 sessions, the others wait for a free one.
+	gate := make(chan struct{})
+	errs := make(chan error, 30)
+	for i := 0; i < 30; i++ {
+		go func(i int) {
+			stdin := &gatedReader{gate: gate, data: strings.NewReader(strconv.Itoa(i))}
+			result, err := sshConf.Exec(context.Background(), "cat", &RunOptions{Stdin: stdin})
+			if err == nil && result.Stdout != strconv.Itoa(i) {
+				err = fmt.Errorf("unexpected output: %s", result.Stdout)
+			}
+			errs <- err
+		}(i)
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&s.sessions) == 10 }, "expected 10 sessions")
+	close(gate)
+	for i := 0; i < 30; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if _, handshakes := s.stats(); handshakes != 1 {
+		t.Errorf("expected 1 handshake, got %d", handshakes)
+	}
+}
+
+func TestSSHConfig_SessionRejected(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	s.maxSessions = 2
+	sshConf := s.sshConfig()
+	defer sshConf.Close()
+
+	gate := make(chan struct{})
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := sshConf.Exec(context.Background(), "cat", &RunOptions{Stdin: &gatedReader{gate: gate, data: strings.NewReader("x")}})
+			errs <- err
+		}()
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&s.sessions) == 2 }, "expected 2 sessions")
+
+	// the server refuses a third session, the running ones go on.
+	var openErr *ssh.OpenChannelError
+	if _, _, _, err := sshConf.Run("echo hi", 10); !errors.As(err, &openErr) {
+		t.Errorf("expected *ssh.OpenChannelError, got %v", err)
+	}
+	close(gate)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if out, _, _, err := sshConf.Run("echo hi", 10); err != nil || out != "hi\n" {
+		t.Errorf("unexpected result: %q %v", out, err)
+	}
+	if _, handshakes := s.stats(); handshakes != 1 {
+		t.Errorf("expected 1 handshake, got %d", handshakes)
+	}
+}
+
+func TestSSHConfig_ClientContext(t *testing.T) {
+	// a server which never answers the handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	sshConf := &SSHConfig{User: "john", Server: host, Port: port, Password: "secret", HostKeyPolicy: HostKeyInsecure, DisableAgent: true}
+
+	first := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, _, err := sshConf.RunContext(ctx, "echo hi")
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// a caller waiting for the dial of another one gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := sshConf.RunContext(ctx, "echo hi"); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the caller waited for the other dial: %s", elapsed)
+	}
+	if err := <-first; err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestSSHConfig_DialContext(t *testing.T) {
+	sshConf := &SSHConfig{Server: "example.com", DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := sshConf.CliContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestSSHConfig_StreamExitStatus(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	sshConf := s.sshConfig()
+
+	for command, want := range map[string]bool{"echo hi": true, "exit 3": false} {
+		stdout, stderr, done, err := sshConf.Stream(command, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok := drainStream(stdout, stderr, done)
+		if ok != want {
+			t.Errorf("%s: expected %v on done, got %v", command, want, ok)
+		}
+	}
+
+	stdout, stderr, done, err := sshConf.StreamWithOptions(context.Background(), "exit 3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exitErr *ExitError
+	if err := drainStreamErr(stdout, stderr, done); !errors.As(err, &exitErr) || exitErr.Result.ExitCode != 3 {
+		t.Errorf("expected *ExitError with status 3, got %v", err)
+	}
+}
+
+func drainStream(stdout, stderr chan string, done chan bool) bool {
+	for {
+		select {
+		case <-stdout:
+		case <-stderr:
+		case ok := <-done:
+			return ok
+		}
+	}
+}
+
+func drainStreamErr(stdout, stderr chan string, done chan error) error {
+	for {
+		select {
+		case <-stdout:
+		case <-stderr:
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+func TestSSHConfig_JumpHosts(t *testing.T) {
+	first, second, target := startTestServer(t), startTestServer(t), startTestServer(t)
+	defer first.close()
+	defer second.close()
+	defer target.close()
+	sshConf := target.sshConfig()
+	sshConf.JumpHosts = []*SSHConfig{first.sshConfig(), second.sshConfig()}
+
+	if out, _, _, err := sshConf.Run("echo hi", 10); err != nil || out != "hi\n" {
+		t.Fatalf("unexpected result: %q %v", out, err)
+	}
+	// every hop is reached through the previous one.
+	for _, hop := range []struct {
+		s    *testServer
+		want string
+	}{{first, second.addr}, {second, target.addr}} {
+		hop.s.mu.Lock()
+		got := hop.s.directTCPIP
+		hop.s.mu.Unlock()
+		if len(got) != 1 || got[0] != hop.want {
+			t.Errorf("expected a direct-tcpip channel to %s, got %v", hop.want, got)
+		}
+	}
+
+	// the jump clients are closed along with the client.
+	if err := sshConf.Close(); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []*testServer{first, second, target} {
+		eventually(t, func() bool { openConns, _ := s.stats(); return openConns == 0 }, "the connections should be closed")
+	}
+}
+
+func TestSSHConfig_JumpHostsError(t *testing.T) {
+	first, second, target := startTestServer(t), startTestServer(t), startTestServer(t)
+	defer first.close()
+	defer second.close()
+	defer target.close()
+
+	// the target refuses the connection.
+	unreachable := target.sshConfig()
+	target.close()
+	unreachable.JumpHosts = []*SSHConfig{first.sshConfig(), second.sshConfig()}
+	if _, _, _, err := unreachable.Run("echo hi", 10); err == nil || !strings.Contains(err.Error(), "jump to "+target.addr) {
+		t.Errorf("expected a jump error, got %v", err)
+	}
+	// the last hop fails the handshake.
+	wrongPassword := second.sshConfig()
+	wrongPassword.Password = "wrong"
+	wrongPassword.JumpHosts = []*SSHConfig{first.sshConfig()}
+	if _, _, _, err := wrongPassword.Run("echo hi", 10); err == nil {
+		t.Error("expected an authentication error")
+	}
+
+	// the earlier jump clients are closed.
+	for _, s := range []*testServer{first, second} {
+		eventually(t, func() bool { openConns, _ := s.stats(); return openConns == 0 }, "the jump connections should be closed")
+	}
+}
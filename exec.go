@@ -0,0 +1,622 @@
+package easyssh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gaols/goutils"
+	"golang.org/x/crypto/ssh"
+)
+
+// RunOptions tunes the execution of a remote command, a nil *RunOptions is valid and uses the defaults.
+type RunOptions struct {
+	// Timeout stops the command once elapsed, zero means no timeout.
+	Timeout time.Duration
+	// Stdin is fed to the command, which sees EOF once Stdin is exhausted. It is not read anymore once
+	// the command is over, but a Read blocking then, like on a pipe or a terminal, keeps a goroutine
+	// until it returns: close Stdin once the call returns if it may block.
+	Stdin io.Reader
+	// Stdout and Stderr receive the output of the command byte for byte as it is produced,
+	// it is then not kept in the Result.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Dir is the working directory of the command, the home directory of the user by default.
+	Dir string
+	// Env sets environment variables of the command. They are passed to the server with setenv
+	// requests, which servers usually accept only for some names (AcceptEnv), the ones refused
+	// are exported by the remote shell instead.
+	Env map[string]string
+	// Umask is the octal file mode creation mask of the command, like "027".
+	Umask string
+	// PTY, if set, runs the command in a pseudo terminal, for the commands which behave differently
+	// when they are not run in a terminal. The remote terminal merges stderr into stdout.
+	PTY *PTY
+	// ForwardSignals sends the SIGINT and SIGTERM received by the local process to the command while
+	// it runs, so that Ctrl-C interrupts the remote command rather than the local process.
+	ForwardSignals bool
+	// Idempotent allows the command to be retried under the SSHConfig retry policy, the output of
+	// the failed attempts may already have been written to Stdout and Stderr or passed to the line
+	// handler. A command reading Stdin is only retried if Stdin is an io.Seeker.
+	Idempotent bool
+}
+
+// PTY describes the pseudo terminal requested for a command.
+type PTY struct {
+	// Term is the terminal type, xterm by default.
+	Term string
+	// Width and Height are the window size in characters, 80x24 by default.
+	Width, Height int
+	// Modes are the terminal modes, echo on by default.
+	Modes ssh.TerminalModes
+}
+
+// request asks for the pseudo terminal on session.
+func (pty *PTY) request(session *ssh.Session) error {
+	term := goutils.DefaultIfBlank(pty.Term, "xterm")
+	width, height := pty.Width, pty.Height
+	if width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	modes := pty.Modes
+	if modes == nil {
+		modes = ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	}
+	return session.RequestPty(term, height, width, modes)
+}
+
+// Result is the outcome of a remote command.
+type Result struct {
+	Command string
+	Stdout  string
+	Stderr  string
+	// ExitCode is the exit status of the command, 128+n if it was killed by signal n,
+	// -1 if the server reported neither.
+	ExitCode int
+	// Signal is the signal which killed the command, if any.
+	Signal   ssh.Signal
+	Duration time.Duration
+	// TimedOut tells whether the command was stopped because its timeout or context deadline expired.
+	TimedOut bool
+}
+
+// ExitError is returned when a remote command exits with a non zero status, is killed by a signal
+// or ends without reporting how. Err is the underlying *ssh.ExitError or *ssh.ExitMissingError.
+type ExitError struct {
+	Result *Result
+	Err    error
+}
+
+func (e *ExitError) Error() string {
+	if e.Result.Command == "" {
+		// the login shell of Interactive
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Result.Command, e.Err)
+}
+
+// Unwrap returns the underlying *ssh.ExitError or *ssh.ExitMissingError.
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Exec runs command on remote machine and returns its Result, opts may be nil.
+// Unless opts redirects them, stdout and stderr are kept in the Result exactly as the command wrote them.
+// A command which does not exit with status 0 is reported as an *ExitError along with its Result,
+// if ctx is done or the timeout expires first the command is stopped and ctx.Err() is returned,
+// at most 2*KillGracePeriod later.
+func (sshConf *SSHConfig) Exec(ctx context.Context, command string, opts *RunOptions) (*Result, error) {
+	o := RunOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	var stdoutBuf, stderrBuf bytes.Buffer
+	if o.Stdout == nil {
+		o.Stdout = &stdoutBuf
+	}
+	if o.Stderr == nil {
+		o.Stderr = &stderrBuf
+	}
+
+	var result *Result
+	err := sshConf.attempt(ctx, &o, func(ctx context.Context) error {
+		result = nil
+		stdoutBuf.Reset()
+		stderrBuf.Reset()
+		p, err := sshConf.start(ctx, command, &o)
+		if err != nil {
+			return err
+		}
+		result, err = p.wait()
+		result.Stdout = stdoutBuf.String()
+		result.Stderr = stderrBuf.String()
+		return err
+	})
+	return result, err
+}
+
+// attempt runs fn, retrying it under the retry policy if opts marks the command as idempotent.
+// Stdin is rewound before each attempt, a command reading from another kind of reader is not retried.
+func (sshConf *SSHConfig) attempt(ctx context.Context, opts *RunOptions, fn func(ctx context.Context) error) error {
+	if opts == nil || !opts.Idempotent {
+		return fn(ctx)
+	}
+	seeker, ok := opts.Stdin.(io.Seeker)
+	if opts.Stdin != nil && !ok {
+		return fn(ctx)
+	}
+
+	var offset int64
+	if seeker != nil {
+		var err error
+		if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return fn(ctx)
+		}
+	}
+	return sshConf.retry(ctx, func(ctx context.Context) error {
+		if seeker != nil {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		return fn(ctx)
+	})
+}
+
+// execute runs command and calls lineHandler with every line of its output, never concurrently.
+// The Result is nil only if the command could not be started.
+func (sshConf *SSHConfig) execute(ctx context.Context, command string, opts *RunOptions, lineHandler func(line string, lineType int)) (*Result, error) {
+	var result *Result
+	err := sshConf.attempt(ctx, opts, func(ctx context.Context) error {
+		result = nil
+		p, err := sshConf.startLines(ctx, command, opts, lineHandler)
+		if err != nil {
+			return err
+		}
+		result, err = p.wait()
+		return err
+	})
+	return result, err
+}
+
+// startLines is like start, lineHandler is called with every line of the output, never concurrently.
+func (sshConf *SSHConfig) startLines(ctx context.Context, command string, opts *RunOptions, lineHandler func(line string, lineType int)) (*Process, error) {
+	o := RunOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	var mu sync.Mutex
+	stdout := &lineWriter{mu: &mu, lineType: TypeStdout, handler: lineHandler}
+	stderr := &lineWriter{mu: &mu, lineType: TypeStderr, handler: lineHandler}
+	o.Stdout, o.Stderr = stdout, stderr
+
+	p, err := sshConf.start(ctx, command, &o)
+	if err != nil {
+		return nil, err
+	}
+	p.lineWriters = []*lineWriter{stdout, stderr}
+	return p, nil
+}
+
+// outputWriter copies the output of a command to w until it is detached, further writes are dropped.
+type outputWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	detached bool
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.detached {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+// detach stops the copy to w, the write in progress, if any, is over once it returns.
+func (w *outputWriter) detach() {
+	w.mu.Lock()
+	w.detached = true
+	w.mu.Unlock()
+}
+
+// lineWriter calls handler with every line written to it, without the line terminator.
+// Lines can be of any length.
+type lineWriter struct {
+	mu       *sync.Mutex // shared by the writers of a command so that handler is never called concurrently
+	lineType int
+	handler  func(line string, lineType int)
+	buf      []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	start := 0
+	for {
+		i := bytes.IndexByte(w.buf[start:], '\n')
+		if i < 0 {
+			break
+		}
+		w.handler(string(bytes.TrimSuffix(w.buf[start:start+i], []byte("\r"))), w.lineType)
+		start += i + 1
+	}
+	w.buf = append(w.buf[:0], w.buf[start:]...)
+	return len(p), nil
+}
+
+// flush passes the last line to handler if it was not terminated.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.handler(string(w.buf), w.lineType)
+		w.buf = nil
+	}
+}
+
+// Process is a command started on a remote machine by Start.
+type Process struct {
+	sshConf *SSHConfig
+	session *remoteSession
+	command string
+	started time.Time
+	ctx     context.Context
+	cancel  context.CancelFunc
+	exited  chan struct{} // closed once the output is fully copied and the exit status known
+	waitErr error
+	watched chan struct{} // closed once the command is over or given up, see watch
+	ended   time.Time
+	ctxErr  error // the error of ctx if it was done before the command exited
+	gaveUp  bool  // the command was still running after it was terminated
+	outputs []*outputWriter
+
+	lineWriters []*lineWriter // flushed once the command is over
+
+	// stdout and stderr keep the output which is not redirected, for Wait.
+	stdout, stderr *bytes.Buffer
+	waitOnce       sync.Once
+	result         *Result
+	err            error
+}
+
+// Start starts command on remote machine and returns its Process without waiting for it to exit, opts may be nil.
+// Unless opts redirects them, stdout and stderr are kept in the Result returned by Wait. The command is not
+// retried even if opts marks it as idempotent. It is stopped like by Exec once ctx is done or the timeout of
+// opts expires, whether Wait is called or not.
+func (sshConf *SSHConfig) Start(ctx context.Context, command string, opts *RunOptions) (*Process, error) {
+	o := RunOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	var stdout, stderr *bytes.Buffer
+	if o.Stdout == nil {
+		stdout = &bytes.Buffer{}
+		o.Stdout = stdout
+	}
+	if o.Stderr == nil {
+		stderr = &bytes.Buffer{}
+		o.Stderr = stderr
+	}
+	p, err := sshConf.start(ctx, command, &o)
+	if err != nil {
+		return nil, err
+	}
+	p.stdout, p.stderr = stdout, stderr
+	return p, nil
+}
+
+// Signal sends sig to the command, the server may not support it.
+func (p *Process) Signal(sig ssh.Signal) error {
+	return p.session.Signal(sig)
+}
+
+// Wait waits for the command to exit and returns its Result, like Exec does. It can be called more than once.
+func (p *Process) Wait() (*Result, error) {
+	p.waitOnce.Do(func() {
+		p.result, p.err = p.wait()
+		if p.stdout != nil {
+			p.result.Stdout = p.stdout.String()
+		}
+		if p.stderr != nil {
+			p.result.Stderr = p.stderr.String()
+		}
+	})
+	return p.result, p.err
+}
+
+// Close closes the session of the command, which the server usually ends with SIGHUP,
+// waits for it to exit and returns the error of the close.
+func (p *Process) Close() error {
+	err := p.session.release()
+	_, _ = p.Wait()
+	return err
+}
+
+// start runs command on a new session, its output is copied to opts.Stdout and opts.Stderr.
+func (sshConf *SSHConfig) start(ctx context.Context, command string, opts *RunOptions) (*Process, error) {
+	if opts == nil {
+		opts = &RunOptions{}
+	}
+
+	// connect to remote host
+	session, err := sshConf.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PTY != nil {
+		if err = opts.PTY.request(session.Session); err != nil {
+			session.release()
+			return nil, fmt.Errorf("request pty error: %w", err)
+		}
+	}
+	// the output is detached from opts once the command is given up, while the ssh package may still copy it.
+	var outputs []*outputWriter
+	attach := func(w io.Writer) io.Writer {
+		if w == nil {
+			return nil
+		}
+		out := &outputWriter{w: w}
+		outputs = append(outputs, out)
+		return out
+	}
+	session.Stdout = attach(opts.Stdout)
+	session.Stderr = attach(opts.Stderr)
+	// stdin is copied by hand rather than through session.Stdin, as Wait would otherwise
+	// not return before Stdin is exhausted even if the command is already over.
+	var stdin io.WriteCloser
+	if opts.Stdin != nil {
+		if stdin, err = session.StdinPipe(); err != nil {
+			session.release()
+			return nil, err
+		}
+	}
+	// an empty command starts the login shell, see Interactive.
+	if command == "" {
+		err = session.Shell()
+	} else {
+		var remoteCommand string
+		if remoteCommand, err = opts.setup(session.Session, command); err == nil {
+			err = session.Start(remoteCommand)
+		}
+	}
+	if err != nil {
+		session.release()
+		return nil, err
+	}
+
+	p := &Process{
+		sshConf: sshConf,
+		session: session,
+		command: command,
+		started: time.Now(),
+		exited:  make(chan struct{}),
+		watched: make(chan struct{}),
+		outputs: outputs,
+	}
+	if stdin != nil {
+		go copyStdin(stdin, opts.Stdin, p.exited)
+	}
+	if opts.Timeout > 0 {
+		p.ctx, p.cancel = context.WithTimeout(ctx, opts.Timeout)
+	} else {
+		p.ctx, p.cancel = context.WithCancel(ctx)
+	}
+
+	go func() {
+		// Wait returns once the output is copied
+		p.waitErr = session.Wait()
+		close(p.exited)
+	}()
+	go p.watch()
+	if opts.ForwardSignals {
+		p.forwardSignals()
+	}
+	return p, nil
+}
+
+// copyStdin copies r to the stdin of a command until r is exhausted or the command is over, exited
+// is closed then. A Read blocking after the command is over holds the copy until it returns, its data is dropped.
+func copyStdin(stdin io.WriteCloser, r io.Reader, exited <-chan struct{}) {
+	defer stdin.Close()
+	buf := make([]byte, 32*1024)
+	for {
+		select {
+		case <-exited:
+			return
+		default:
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			// writes fail once the command is over, which is reported by Wait.
+			if _, werr := stdin.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// forwardSignals sends the SIGINT and SIGTERM received by the local process to the command, until it exits
+// or is given up.
+func (p *Process) forwardSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case <-p.watched:
+				return
+			case sig := <-sigs:
+				remoteSig := ssh.SIGTERM
+				if sig == os.Interrupt {
+					remoteSig = ssh.SIGINT
+				}
+				_ = p.session.Signal(remoteSig)
+			}
+		}
+	}()
+}
+
+// setup sends the environment variables of opts to session and returns the command line running command
+// in Dir with Umask and the variables refused by the server.
+func (opts *RunOptions) setup(session *ssh.Session, command string) (string, error) {
+	var setenv func(name, value string) error
+	if session != nil {
+		setenv = session.Setenv
+	}
+	prefix, err := opts.shellPrefix(setenv)
+	if err != nil {
+		return "", err
+	}
+	return prefix + command, nil
+}
+
+// shellPrefix returns the shell commands moving to Dir, setting Umask and exporting Env, to be put ahead
+// of a command line. The variables are passed with setenv first if it is not nil, only the ones it refuses
+// are exported.
+func (opts *RunOptions) shellPrefix(setenv func(name, value string) error) (string, error) {
+	var prefix strings.Builder
+	if opts.Dir != "" {
+		prefix.WriteString(Command("cd", opts.Dir).Or("exit").String() + "; ")
+	}
+	if opts.Umask != "" {
+		if !umaskRegexp.MatchString(opts.Umask) {
+			return "", fmt.Errorf("invalid umask: %s", opts.Umask)
+		}
+		prefix.WriteString(Command("umask", opts.Umask).Or("exit").String() + "; ")
+	}
+
+	names := make([]string, 0, len(opts.Env))
+	for name := range opts.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !envNameRegexp.MatchString(name) {
+			return "", fmt.Errorf("invalid environment variable name: %s", name)
+		}
+		if setenv == nil || setenv(name, opts.Env[name]) != nil {
+			prefix.WriteString("export " + name + "=" + Quote(opts.Env[name]) + "; ")
+		}
+	}
+	return prefix.String(), nil
+}
+
+var (
+	umaskRegexp   = regexp.MustCompile(`^[0-7]{1,4}$`)
+	envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// watch stops the command if its context is done before it exits, whether wait is called or not.
+func (p *Process) watch() {
+	defer close(p.watched)
+	defer p.cancel()
+	select {
+	case <-p.exited:
+	case <-p.ctx.Done():
+		p.ctxErr = p.ctx.Err()
+		// a command which is still not over is given up, without its exit status.
+		p.gaveUp = !p.sshConf.terminate(p.session, p.exited)
+	}
+	p.ended = time.Now()
+}
+
+// wait waits for the command to exit, it is stopped if its context is done first.
+func (p *Process) wait() (*Result, error) {
+	defer p.session.release()
+
+	<-p.watched
+	if p.gaveUp {
+		// the output is not written anymore once detached, so it can be read.
+		for _, out := range p.outputs {
+			out.detach()
+		}
+	}
+	for _, w := range p.lineWriters {
+		w.flush()
+	}
+
+	result := &Result{Command: p.command, Duration: p.ended.Sub(p.started)}
+	if p.gaveUp {
+		result.ExitCode = -1
+		result.TimedOut = p.ctxErr == context.DeadlineExceeded
+		return result, p.ctxErr
+	}
+	switch e := p.waitErr.(type) {
+	case *ssh.ExitError:
+		result.ExitCode = e.ExitStatus()
+		result.Signal = ssh.Signal(e.Signal())
+	case *ssh.ExitMissingError:
+		result.ExitCode = -1
+	}
+
+	if p.ctxErr != nil {
+		result.TimedOut = p.ctxErr == context.DeadlineExceeded
+		return result, p.ctxErr
+	}
+	if p.waitErr != nil {
+		if err := p.session.lostErr(); err != nil {
+			return result, err
+		}
+	}
+	switch p.waitErr.(type) {
+	case nil:
+		return result, nil
+	case *ssh.ExitError, *ssh.ExitMissingError:
+		return result, &ExitError{Result: result, Err: p.waitErr}
+	}
+	return result, p.waitErr
+}
+
+// terminate stops the command running on session, exited is closed once it is over. The command
+// receives TimeoutSignal, then SIGKILL along with the close of the session if it is still running
+// after KillGracePeriod. terminate reports whether the command is over after another KillGracePeriod,
+// so it returns at most 2*KillGracePeriod after it is called. Only the session is closed, the other
+// sessions of the connection go on. The output copies of a command given up end once the server
+// closes the session or the connection is closed.
+func (sshConf *SSHConfig) terminate(session *remoteSession, exited <-chan struct{}) bool {
+	grace := sshConf.KillGracePeriod
+	if grace <= 0 {
+		grace = defaultKillGracePeriod
+	}
+	sig := sshConf.TimeoutSignal
+	if sig == "" {
+		sig = ssh.SIGTERM
+	}
+
+	_ = session.Signal(sig)
+	if waitClosed(exited, grace) {
+		return true
+	}
+	// servers may ignore signals, closing the session makes them hang up the command.
+	_ = session.Signal(ssh.SIGKILL)
+	session.release()
+	return waitClosed(exited, grace)
+}
+
+// waitClosed waits at most timeout for ch to be closed and reports whether it was.
+func waitClosed(ch <-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
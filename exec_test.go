@@ -0,0 +1,282 @@
+package easyssh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExitErrorUnwrap(t *testing.T) {
+	var err error = &ExitError{Result: &Result{Command: "true", ExitCode: -1}, Err: &ssh.ExitMissingError{}}
+
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Result.ExitCode != -1 {
+		t.Error("expected *ExitError")
+	}
+	var missing *ssh.ExitMissingError
+	if !errors.As(err, &missing) {
+		t.Error("expected *ssh.ExitMissingError to be unwrapped")
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	var mu sync.Mutex
+	w := &lineWriter{mu: &mu, lineType: TypeStdout, handler: func(line string, lineType int) {
+		lines = append(lines, line)
+	}}
+	long := strings.Repeat("a", 100*1024)
+	for _, chunk := range []string{"one\r\ntw", "o\n", long, "\n\nlast"} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.flush()
+
+	want := []string{"one", "two", long, "", "last"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("unexpected lines: %d lines", len(lines))
+	}
+}
+
+func TestExitErrorShell(t *testing.T) {
+	err := &ExitError{Result: &Result{ExitCode: 3}, Err: errors.New("Process exited with status 3")}
+	if err.Error() != "Process exited with status 3" {
+		t.Errorf("unexpected message: %s", err)
+	}
+	err.Result.Command = "false"
+	if err.Error() != "false: Process exited with status 3" {
+		t.Errorf("unexpected message: %s", err)
+	}
+}
+
+func TestRunOptionsSetup(t *testing.T) {
+	opts := &RunOptions{Dir: "/srv/my app", Umask: "027"}
+	command, err := opts.setup(nil, "tar xf app.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "cd '/srv/my app' || exit; umask 027 || exit; tar xf app.tar"; command != want {
+		t.Errorf("got %s, want %s", command, want)
+	}
+
+	if _, err := (&RunOptions{Umask: "0; rm -rf /"}).setup(nil, "true"); err == nil {
+		t.Error("invalid umask should fail")
+	}
+	if _, err := (&RunOptions{Env: map[string]string{"A=B": "c"}}).setup(nil, "true"); err == nil {
+		t.Error("invalid variable name should fail")
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	sshConf := s.sshConfig()
+	sshConf.KillGracePeriod = 200 * time.Millisecond
+
+	// a command running along the timed out ones keeps its session.
+	gate := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sshConf.Exec(context.Background(), "cat", &RunOptions{Stdin: &gatedReader{gate: gate, data: strings.NewReader("x")}})
+		errs <- err
+	}()
+	eventually(t, func() bool { return atomic.LoadInt32(&s.sessions) == 1 }, "expected 1 session")
+
+	// trap exits on TERM.
+	result, err := sshConf.Exec(context.Background(), "trap", &RunOptions{Timeout: 100 * time.Millisecond})
+	if err != context.DeadlineExceeded || !result.TimedOut {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if result.Stdout != "trapped TERM\n" || result.ExitCode != 130 {
+		t.Errorf("unexpected result: %q %d", result.Stdout, result.ExitCode)
+	}
+
+	// hang ignores signals, it is given up after 2*KillGracePeriod.
+	start := time.Now()
+	result, err = sshConf.Exec(context.Background(), "hang", &RunOptions{Timeout: 100 * time.Millisecond})
+	if err != context.DeadlineExceeded || !result.TimedOut {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond+2*sshConf.KillGracePeriod+time.Second {
+		t.Errorf("the command was stopped after %s", elapsed)
+	}
+
+	close(gate)
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+	if out, _, _, err := sshConf.Run("echo hi", 10); err != nil || out != "hi\n" {
+		t.Errorf("unexpected result: %q %v", out, err)
+	}
+	if _, handshakes := s.stats(); handshakes != 1 {
+		t.Errorf("expected 1 handshake, got %d", handshakes)
+	}
+}
+
+func TestExecStdin(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	sshConf := s.sshConfig()
+
+	// cat sees EOF once stdin is exhausted.
+	result, err := sshConf.Exec(context.Background(), "cat", &RunOptions{Stdin: strings.NewReader("hello\n"), Timeout: 5 * time.Second})
+	if err != nil || result.Stdout != "hello\n" {
+		t.Errorf("unexpected result: %v %v", result, err)
+	}
+
+	// a command not reading stdin returns while stdin blocks, closing stdin then ends the copy.
+	stdin := &blockingReader{closed: make(chan struct{})}
+	result, err = sshConf.Exec(context.Background(), "echo hi", &RunOptions{Stdin: stdin, Timeout: 5 * time.Second})
+	if err != nil || result.Stdout != "hi\n" {
+		t.Errorf("unexpected result: %v %v", result, err)
+	}
+	close(stdin.closed)
+	time.Sleep(50 * time.Millisecond)
+	if reads := atomic.LoadInt32(&stdin.reads); reads > 1 {
+		t.Errorf("expected stdin to be read at most once, got %d", reads)
+	}
+}
+
+// blockingReader blocks until closed, then returns data forever.
+type blockingReader struct {
+	closed chan struct{}
+	reads  int32
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.closed
+	atomic.AddInt32(&r.reads, 1)
+	return copy(p, "data\n"), nil
+}
+
+func TestStart(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	sshConf := s.sshConfig()
+
+	p, err := sshConf.Start(context.Background(), "trap", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(ssh.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	result, err := p.Wait()
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || result.ExitCode != 130 || result.Stdout != "trapped INT\n" {
+		t.Errorf("unexpected result: %+v %v", result, err)
+	}
+	// Wait returns the same result again.
+	if again, againErr := p.Wait(); again != result || againErr != err {
+		t.Error("expected the same result")
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+
+	// Close ends a running command.
+	p, err = sshConf.Start(context.Background(), "sleep", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&s.sessions) == 0 }, "the session should be closed")
+}
+
+func TestStartContext(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	sshConf := s.sshConfig()
+
+	// the command is stopped once its context is done or it times out, before Wait is called.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, err := sshConf.Start(ctx, "sleep", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timedOut, err := sshConf.Start(context.Background(), "sleep", &RunOptions{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return reflect.DeepEqual(s.signals, []string{"TERM", "TERM"})
+	}, "expected the commands to receive TERM")
+
+	if _, err := cancelled.Wait(); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	result, err := timedOut.Wait()
+	if err != context.DeadlineExceeded || !result.TimedOut {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestStartForwardSignals(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	sshConf := s.sshConfig()
+
+	p, err := sshConf.Start(context.Background(), "trap", &RunOptions{ForwardSignals: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(os.Interrupt); err != nil {
+		t.Skipf("cannot interrupt the test process: %v", err)
+	}
+	if result, _ := p.Wait(); result.Stdout != "trapped INT\n" {
+		t.Errorf("expected the interrupt to be forwarded, got %q", result.Stdout)
+	}
+}
+
+func TestExecGiveUp(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	defer atomic.StoreInt32(&s.stalled, 0)
+	sshConf := s.sshConfig()
+	sshConf.KillGracePeriod = 50 * time.Millisecond
+
+	// the server stops reading while flood writes, the command cannot be stopped and is given up.
+	stall := func() {
+		eventually(t, func() bool { return atomic.LoadInt32(&s.sessions) == 1 }, "expected 1 session")
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&s.stalled, 1)
+	}
+	go stall()
+	result, err := sshConf.Exec(context.Background(), "flood", &RunOptions{Timeout: 200 * time.Millisecond})
+	if err != context.DeadlineExceeded || !strings.HasPrefix(result.Stdout, "flood\n") {
+		t.Errorf("unexpected result: %q %v", result.Stdout, err)
+	}
+	// the output still copied by the ssh package is dropped.
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt32(&s.stalled, 0)
+	eventually(t, func() bool { return atomic.LoadInt32(&s.sessions) == 0 }, "the session should be closed")
+
+	go stall()
+	stdout, stderr, done, err := sshConf.StreamWithOptions(context.Background(), "flood", &RunOptions{Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := drainStreamErr(stdout, stderr, done); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+}
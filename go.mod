@@ -5,5 +5,7 @@ go 1.13
 require (
 	github.com/gaols/goutils v1.2.3
 	github.com/pkg/sftp v1.11.0
-	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
+	golang.org/x/term v0.0.0-20201117132131-f5c789dd3221
 )
@@ -0,0 +1,296 @@
+package easyssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyPolicy decides how server host keys are verified.
+type HostKeyPolicy int
+
+const (
+	// HostKeyStrict accepts only servers whose key is listed in known_hosts.
+	HostKeyStrict HostKeyPolicy = iota
+	// HostKeyTOFU trusts unknown servers on first use and records their key in known_hosts,
+	// a changed key is still refused.
+	HostKeyTOFU
+	// HostKeyInsecure accepts any host key, use it only on trusted networks.
+	HostKeyInsecure
+)
+
+// knownHostsLocks serializes the TOFU writes to each known_hosts file.
+var knownHostsLocks = struct {
+	sync.Mutex
+	files map[string]*sync.Mutex
+}{files: make(map[string]*sync.Mutex)}
+
+func knownHostsLock(file string) *sync.Mutex {
+	knownHostsLocks.Lock()
+	defer knownHostsLocks.Unlock()
+	mu, ok := knownHostsLocks.files[file]
+	if !ok {
+		mu = &sync.Mutex{}
+		knownHostsLocks.files[file] = mu
+	}
+	return mu
+}
+
+// UnknownHostKeyError is returned when the server is not listed in any of the known_hosts files.
+type UnknownHostKeyError struct {
+	Host        string
+	KeyType     string
+	Fingerprint string
+}
+
+func (e *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("unknown host %s: no known_hosts entry for %s key %s", e.Host, e.KeyType, e.Fingerprint)
+}
+
+// HostKeyMismatchError is returned when the key presented by the server differs from the one
+// recorded in known_hosts, which may indicate a man-in-the-middle attack.
+type HostKeyMismatchError struct {
+	Host             string
+	KeyType          string
+	Fingerprint      string // fingerprint of the key presented by the server
+	KnownKeyType     string
+	KnownFingerprint string // fingerprint of the key recorded in known_hosts
+	File             string
+	Line             int
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: server presented %s key %s, but %s:%d has %s key %s",
+		e.Host, e.KeyType, e.Fingerprint, e.File, e.Line, e.KnownKeyType, e.KnownFingerprint)
+}
+
+// RevokedHostKeyError is returned when the server presents a key marked @revoked in known_hosts.
+type RevokedHostKeyError struct {
+	Host        string
+	KeyType     string
+	Fingerprint string
+	File        string
+	Line        int
+}
+
+func (e *RevokedHostKeyError) Error() string {
+	return fmt.Sprintf("host key for %s is revoked: %s key %s (%s:%d)", e.Host, e.KeyType, e.Fingerprint, e.File, e.Line)
+}
+
+// defaultKnownHosts returns the known_hosts files OpenSSH consults by default.
+func defaultKnownHosts() []string {
+	files := []string{"/etc/ssh/ssh_known_hosts"}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append([]string{filepath.Join(home, ".ssh", "known_hosts")}, files...)
+	}
+	return files
+}
+
+// knownHostsFiles returns the configured known_hosts files, falling back to the OpenSSH defaults.
+func (sshConf *SSHConfig) knownHostsFiles() []string {
+	if len(sshConf.KnownHosts) > 0 {
+		return sshConf.KnownHosts
+	}
+	return defaultKnownHosts()
+}
+
+// hostKeyCallback builds the callback verifying server keys according to HostKeyPolicy.
+func (sshConf *SSHConfig) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	var cb ssh.HostKeyCallback
+	switch sshConf.HostKeyPolicy {
+	case HostKeyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case HostKeyTOFU:
+		known, err := knownHostsCallback(sshConf.knownHostsFiles())
+		if err != nil {
+			return nil, err
+		}
+		cb = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := known(hostname, remote, key)
+			if _, ok := err.(*UnknownHostKeyError); ok {
+				return sshConf.recordHostKey(hostname, remote, key)
+			}
+			return err
+		}
+	case HostKeyStrict:
+		known, err := knownHostsCallback(sshConf.knownHostsFiles())
+		if err != nil {
+			return nil, err
+		}
+		cb = known
+	default:
+		return nil, fmt.Errorf("unknown host key policy: %d", sshConf.HostKeyPolicy)
+	}
+
+	if len(sshConf.HostCAs) == 0 {
+		return cb, nil
+	}
+	// the certificates signed by HostCAs bypass known_hosts, but not its revocations.
+	revoked, err := knownHostsRevoked(sshConf.knownHostsFiles())
+	if err != nil {
+		return nil, err
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: sshConf.isHostCA,
+		IsRevoked:       func(cert *ssh.Certificate) bool { return revokedCertKey(revoked, cert) != nil },
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// certificates signed by other authorities are left to the known_hosts files.
+		if cert, ok := key.(*ssh.Certificate); ok && sshConf.isHostCA(cert.SignatureKey, hostname) {
+			if known := revokedCertKey(revoked, cert); known != nil {
+				return &RevokedHostKeyError{
+					Host:        hostname,
+					KeyType:     known.Key.Type(),
+					Fingerprint: ssh.FingerprintSHA256(known.Key),
+					File:        known.Filename,
+					Line:        known.Line,
+				}
+			}
+			return checker.CheckHostKey(hostname, remote, key)
+		}
+		return cb(hostname, remote, key)
+	}, nil
+}
+
+// knownHostsRevoked returns the keys marked @revoked in the known_hosts files, by their wire format.
+// Files that do not exist are treated as empty.
+func knownHostsRevoked(knownHosts []string) (map[string]*knownhosts.KnownKey, error) {
+	revoked := make(map[string]*knownhosts.KnownKey)
+	for _, file := range knownHosts {
+		if !IsFileExists(file) {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			marker, _, key, _, _, err := ssh.ParseKnownHosts(line)
+			if err == io.EOF {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, i+1, err)
+			}
+			if marker == "revoked" {
+				revoked[string(key.Marshal())] = &knownhosts.KnownKey{Key: key, Filename: file, Line: i + 1}
+			}
+		}
+	}
+	return revoked, nil
+}
+
+// revokedCertKey returns the revoked entry of cert, of the host key it certifies or of its signing CA, if any.
+func revokedCertKey(revoked map[string]*knownhosts.KnownKey, cert *ssh.Certificate) *knownhosts.KnownKey {
+	for _, key := range []ssh.PublicKey{cert, cert.Key, cert.SignatureKey} {
+		if known, ok := revoked[string(key.Marshal())]; ok {
+			return known
+		}
+	}
+	return nil
+}
+
+// isHostCA tells whether auth is one of HostCAs.
+func (sshConf *SSHConfig) isHostCA(auth ssh.PublicKey, address string) bool {
+	for _, ca := range sshConf.HostCAs {
+		if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownHostsCallback verifies server keys against the known_hosts files,
+// files that do not exist are treated as empty.
+func knownHostsCallback(knownHosts []string) (ssh.HostKeyCallback, error) {
+	files := make([]string, 0)
+	for _, file := range knownHosts {
+		if IsFileExists(file) {
+			files = append(files, file)
+		}
+	}
+
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return hostKeyError(hostname, key, cb(hostname, remote, key))
+	}, nil
+}
+
+// recordHostKey appends key to the first known_hosts file. The files are checked again under the
+// lock so concurrent first connections to the same host record it only once, and the line is
+// written with a single append so other processes never observe a partial entry.
+func (sshConf *SSHConfig) recordHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	files := sshConf.knownHostsFiles()
+	file := files[0]
+	mu := knownHostsLock(file)
+	mu.Lock()
+	defer mu.Unlock()
+
+	cb, err := knownHostsCallback(files)
+	if err != nil {
+		return err
+	}
+	if err = cb(hostname, remote, key); err == nil {
+		return nil
+	} else if _, ok := err.(*UnknownHostKeyError); !ok {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer Close(f)
+	_, err = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	return err
+}
+
+// hostKeyError translates the errors of the knownhosts package into the typed errors of this package.
+func hostKeyError(hostname string, key ssh.PublicKey, err error) error {
+	switch e := err.(type) {
+	case *knownhosts.KeyError:
+		if len(e.Want) == 0 {
+			return &UnknownHostKeyError{Host: hostname, KeyType: key.Type(), Fingerprint: ssh.FingerprintSHA256(key)}
+		}
+		known := e.Want[0]
+		for _, w := range e.Want {
+			if w.Key.Type() == key.Type() {
+				known = w
+				break
+			}
+		}
+		return &HostKeyMismatchError{
+			Host:             hostname,
+			KeyType:          key.Type(),
+			Fingerprint:      ssh.FingerprintSHA256(key),
+			KnownKeyType:     known.Key.Type(),
+			KnownFingerprint: ssh.FingerprintSHA256(known.Key),
+			File:             known.Filename,
+			Line:             known.Line,
+		}
+	case *knownhosts.RevokedError:
+		return &RevokedHostKeyError{
+			Host:        hostname,
+			KeyType:     key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key),
+			File:        e.Revoked.Filename,
+			Line:        e.Revoked.Line,
+		}
+	}
+	return err
+}
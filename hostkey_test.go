@@ -0,0 +1,178 @@
+package easyssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	dir, err := ioutil.TempDir("", "easyssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "known_hosts")
+	content := ""
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	known := newTestHostKey(t)
+	other := newTestHostKey(t)
+	revoked := newTestHostKey(t)
+	path := writeKnownHosts(t,
+		knownhosts.Line([]string{"example.com"}, known),
+		knownhosts.Line([]string{knownhosts.HashHostname("hashed.example.com")}, known),
+		"@revoked * "+string(ssh.MarshalAuthorizedKey(revoked)),
+	)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	cb, err := (&SSHConfig{KnownHosts: []string{path}}).hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	if err := cb("example.com:22", remote, known); err != nil {
+		t.Errorf("known key rejected: %s", err)
+	}
+	if err := cb("hashed.example.com:22", remote, known); err != nil {
+		t.Errorf("hashed known key rejected: %s", err)
+	}
+
+	err = cb("example.com:22", remote, other)
+	mismatch, ok := err.(*HostKeyMismatchError)
+	if !ok {
+		t.Fatalf("expected *HostKeyMismatchError, got %v", err)
+	}
+	if mismatch.Fingerprint != ssh.FingerprintSHA256(other) || mismatch.KnownFingerprint != ssh.FingerprintSHA256(known) {
+		t.Errorf("unexpected fingerprints: %s", mismatch)
+	}
+
+	if _, ok := cb("unknown.example.com:22", remote, other).(*UnknownHostKeyError); !ok {
+		t.Error("expected *UnknownHostKeyError")
+	}
+	if _, ok := cb("example.com:22", remote, revoked).(*RevokedHostKeyError); !ok {
+		t.Error("expected *RevokedHostKeyError")
+	}
+}
+
+func TestHostKeyTOFU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "easyssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ssh", "known_hosts")
+
+	key := newTestHostKey(t)
+	cb, err := (&SSHConfig{KnownHosts: []string{path}, HostKeyPolicy: HostKeyTOFU}).hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cb("example.com:2222", remote, key); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := knownhosts.Line([]string{"[example.com]:2222"}, key) + "\n"; string(content) != want {
+		t.Errorf("unexpected known_hosts content: %q", content)
+	}
+
+	if _, ok := cb("example.com:2222", remote, newTestHostKey(t)).(*HostKeyMismatchError); !ok {
+		t.Error("changed key should be refused")
+	}
+}
+
+func TestHostKeyCallbackHostCAs(t *testing.T) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := &ssh.Certificate{
+		Key:             newTestHostKey(t),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeKnownHosts(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	cb, err := (&SSHConfig{KnownHosts: []string{path}, HostCAs: []ssh.PublicKey{ca.PublicKey()}}).hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	if err := cb("example.com:22", remote, cert); err != nil {
+		t.Errorf("certificate signed by trusted CA rejected: %s", err)
+	}
+	if err := cb("other.example.com:22", remote, cert); err == nil {
+		t.Error("certificate accepted for a host it does not name")
+	}
+	if _, ok := cb("example.com:22", remote, newTestHostKey(t)).(*UnknownHostKeyError); !ok {
+		t.Error("plain keys should still be checked against known_hosts")
+	}
+
+	// a revoked host key or CA is refused even if the certificate is signed by a trusted CA.
+	for name, key := range map[string]ssh.PublicKey{"host key": cert.Key, "CA": ca.PublicKey()} {
+		revokedPath := writeKnownHosts(t, "# revoked", "@revoked * "+strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+		defer os.RemoveAll(filepath.Dir(revokedPath))
+		cb, err := (&SSHConfig{KnownHosts: []string{revokedPath}, HostCAs: []ssh.PublicKey{ca.PublicKey()}}).hostKeyCallback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var revokedErr *RevokedHostKeyError
+		if err := cb("example.com:22", remote, cert); !errors.As(err, &revokedErr) || revokedErr.Line != 2 {
+			t.Errorf("certificate with a revoked %s accepted: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package easyssh
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrKeepAliveTimeout is returned when the connection was closed because the server stopped answering keepalives.
+var ErrKeepAliveTimeout = errors.New("ssh keepalive timeout: server stopped answering")
+
+// keepAliveConns maps the clients sending keepalives to their connection, as long as they are open.
+var keepAliveConns sync.Map
+
+// keepAliveConn is the connection of a client sending keepalives, its reads fail
+// with ErrKeepAliveTimeout once it is closed for lack of answers.
+type keepAliveConn struct {
+	net.Conn
+	once   sync.Once
+	failed chan struct{}
+}
+
+func newKeepAliveConn(conn net.Conn) *keepAliveConn {
+	return &keepAliveConn{Conn: conn, failed: make(chan struct{})}
+}
+
+func (c *keepAliveConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil && c.timedOut() {
+		return n, ErrKeepAliveTimeout
+	}
+	return n, err
+}
+
+func (c *keepAliveConn) timedOut() bool {
+	select {
+	case <-c.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *keepAliveConn) fail() {
+	c.once.Do(func() {
+		close(c.failed)
+		_ = c.Conn.Close()
+	})
+}
+
+// keepAlive sends a keepalive@openssh.com request every interval, the connection is closed if
+// no answer comes within maxMissed more intervals. It returns once client is closed.
+func (c *keepAliveConn) keepAlive(client *ssh.Client, interval time.Duration, maxMissed int) {
+	defer keepAliveConns.Delete(client)
+
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		// requests are answered in order, so only one is sent at a time.
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+	wait:
+		for missed := 0; ; {
+			select {
+			case <-closed:
+				return
+			case err := <-reply:
+				if err != nil {
+					return
+				}
+				break wait
+			case <-ticker.C:
+				if missed++; missed >= maxMissed {
+					c.fail()
+					return
+				}
+			}
+		}
+	}
+}
+
+// keepAliveErr returns a func reporting ErrKeepAliveTimeout once client is closed because the server
+// stopped answering, the sessions of the client keep it to tell why they were interrupted.
+func keepAliveErr(client *ssh.Client) func() error {
+	v, ok := keepAliveConns.Load(client)
+	if !ok {
+		return func() error { return nil }
+	}
+	conn := v.(*keepAliveConn)
+	return func() error {
+		if conn.timedOut() {
+			return ErrKeepAliveTimeout
+		}
+		return nil
+	}
+}
@@ -0,0 +1,52 @@
+package easyssh
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := newKeepAliveConn(client)
+
+	go func() { _, _ = server.Write([]byte("x")) }()
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.fail()
+	conn.fail()
+	if _, err := conn.Read(buf); err != ErrKeepAliveTimeout {
+		t.Errorf("expected ErrKeepAliveTimeout, got %v", err)
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	sshConf := s.sshConfig()
+	sshConf.KeepAliveInterval = 50 * time.Millisecond
+	sshConf.KeepAliveMaxMissed = 2
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sshConf.Exec(context.Background(), "sleep", nil)
+		errs <- err
+	}()
+	eventually(t, func() bool { return atomic.LoadInt32(&s.sessions) == 1 }, "expected 1 session")
+	// the server stops answering, the running command fails once the missed keepalives are counted.
+	atomic.StoreInt32(&s.silent, 1)
+	select {
+	case err := <-errs:
+		if err != ErrKeepAliveTimeout {
+			t.Errorf("expected ErrKeepAliveTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed")
+	}
+}
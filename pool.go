@@ -0,0 +1,328 @@
+package easyssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrPoolClosed is returned when a session is requested from a closed Pool.
+var ErrPoolClosed = errors.New("ssh pool is closed")
+
+// errClientRemoved is returned when a session is requested on a client removed from the pool meanwhile.
+var errClientRemoved = errors.New("ssh pool: client removed")
+
+// healthCheckTimeout bounds the keepalive checking an idle client before it is reused.
+var healthCheckTimeout = 5 * time.Second
+
+// Pool shares ssh clients between SSHConfig values, set SSHConfig.Pool to make an SSHConfig use it.
+// Clients are keyed by user@host:port and host key verification settings: the SSHConfig values with
+// the same key share the client dialed by the first of them, with its credentials, jump hosts and
+// algorithms, the credentials of the others are not checked.
+type Pool struct {
+	maxSessions int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*pooledClient
+	dials   int
+	closed  bool
+	stop    chan struct{}
+}
+
+// PoolStats is a snapshot of the state of a Pool.
+type PoolStats struct {
+	OpenClients   int // clients currently connected
+	SessionsInUse int // sessions currently opened on those clients
+	Dials         int // clients dialed since the pool was created
+}
+
+type pooledClient struct {
+	key      string
+	ready    chan struct{} // closed once the dial is over
+	client   *ssh.Client
+	err      error
+	slots    chan struct{} // one token per session in use
+	lastUsed time.Time
+}
+
+// NewPool creates a Pool opening at most maxSessions sessions at once on each client, further
+// sessions wait for a free slot. OpenSSH allows 10 sessions per connection by default (MaxSessions
+// in sshd_config). Clients without any session for idleTimeout are closed, 0 keeps them forever.
+func NewPool(maxSessions int, idleTimeout time.Duration) *Pool {
+	if maxSessions <= 0 {
+		maxSessions = defaultMaxSessions
+	}
+	p := &Pool{
+		maxSessions: maxSessions,
+		idleTimeout: idleTimeout,
+		clients:     make(map[string]*pooledClient),
+		stop:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.evictLoop()
+	}
+	return p
+}
+
+// Stats returns the current number of clients and sessions, and the number of dials made so far.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := PoolStats{Dials: p.dials}
+	for _, pc := range p.clients {
+		if pc.client != nil {
+			stats.OpenClients++
+			stats.SessionsInUse += len(pc.slots)
+		}
+	}
+	return stats
+}
+
+// Close closes all the clients of the pool, sessions still running are interrupted.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	clients := p.clients
+	p.clients = make(map[string]*pooledClient)
+	p.mu.Unlock()
+
+	for _, pc := range clients {
+		<-pc.ready
+		if pc.client != nil {
+			_ = pc.client.Close()
+		}
+	}
+	return nil
+}
+
+// session opens a session for sshConf on a pooled client, waiting for a free slot if the client
+// already runs maxSessions sessions. Releasing the session frees its slot.
+func (p *Pool) session(ctx context.Context, sshConf *SSHConfig) (*remoteSession, error) {
+	retried := false
+	for {
+		pc, err := p.get(ctx, sshConf)
+		if err != nil {
+			return nil, err
+		}
+		session, err := p.newSession(ctx, pc)
+		if err == errClientRemoved {
+			continue
+		}
+		// a session refused by the server, like beyond its MaxSessions, says nothing about the client.
+		var openErr *ssh.OpenChannelError
+		if err == nil || ctx.Err() != nil || errors.As(err, &openErr) || retried {
+			return session, err
+		}
+
+		// the server may have dropped the client since it was checked, retry once on a new one.
+		p.remove(pc)
+		retried = true
+	}
+}
+
+func (p *Pool) newSession(ctx context.Context, pc *pooledClient) (*remoteSession, error) {
+	select {
+	case pc.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// the client may have been evicted before the slot was taken, see removeIdle.
+	p.mu.Lock()
+	pooled := p.clients[pc.key] == pc
+	p.mu.Unlock()
+	if !pooled {
+		<-pc.slots
+		return nil, errClientRemoved
+	}
+	release := func() {
+		p.mu.Lock()
+		pc.lastUsed = time.Now()
+		p.mu.Unlock()
+		<-pc.slots
+	}
+
+	session, err := pc.client.NewSession()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return newRemoteSession(pc.client, session, func() error {
+		err := closeSession(session)
+		release()
+		return err
+	}), nil
+}
+
+// client returns the pooled client of sshConf without holding a session slot.
+func (p *Pool) client(ctx context.Context, sshConf *SSHConfig) (*ssh.Client, error) {
+	pc, err := p.get(ctx, sshConf)
+	if err != nil {
+		return nil, err
+	}
+	return pc.client, nil
+}
+
+// get returns a healthy client for sshConf, dialing it if needed. Only the callers asking for
+// the same key wait for the dial, if it was cancelled by the context of another caller they dial again.
+func (p *Pool) get(ctx context.Context, sshConf *SSHConfig) (*pooledClient, error) {
+	key := poolKey(sshConf)
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		pc, ok := p.clients[key]
+		if !ok {
+			pc = &pooledClient{key: key, ready: make(chan struct{}), slots: make(chan struct{}, p.maxSessions)}
+			p.clients[key] = pc
+			p.dials++
+			p.mu.Unlock()
+			p.dial(ctx, pc, sshConf)
+		} else {
+			p.mu.Unlock()
+		}
+
+		select {
+		case <-pc.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if pc.err != nil {
+			p.remove(pc)
+			if ok && ctx.Err() == nil && (pc.err == context.Canceled || pc.err == context.DeadlineExceeded) {
+				continue
+			}
+			return nil, pc.err
+		}
+		if ok {
+			alive, err := p.healthy(ctx, pc)
+			if err != nil {
+				// the caller gave up, which says nothing about the client.
+				return nil, err
+			}
+			if !alive {
+				p.removeIdle(pc)
+				continue
+			}
+		}
+		return pc, nil
+	}
+}
+
+// poolKey returns the key of the client of sshConf, clients are shared only between the SSHConfig
+// values verifying the host key the same way.
+func poolKey(sshConf *SSHConfig) string {
+	user, addr := sshConf.userAndAddr()
+	hostCAs := make([]string, 0, len(sshConf.HostCAs))
+	for _, ca := range sshConf.HostCAs {
+		hostCAs = append(hostCAs, ssh.FingerprintSHA256(ca))
+	}
+	return fmt.Sprintf("%s@%s|%d|%s|%s", user, addr, sshConf.HostKeyPolicy,
+		strings.Join(sshConf.KnownHosts, ","), strings.Join(hostCAs, ","))
+}
+
+func (p *Pool) dial(ctx context.Context, pc *pooledClient, sshConf *SSHConfig) {
+	defer close(pc.ready)
+	client, err := sshConf.CliContext(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.client, pc.err, pc.lastUsed = client, err, time.Now()
+	if err != nil {
+		return
+	}
+	go func() {
+		// forget the client as soon as it is lost.
+		_ = client.Wait()
+		p.remove(pc)
+	}()
+}
+
+// healthy tells whether an idle client answers a keepalive within healthCheckTimeout, clients running
+// sessions are known to be alive. If ctx is done first ctx.Err() is returned, the health is then unknown.
+func (p *Pool) healthy(ctx context.Context, pc *pooledClient) (bool, error) {
+	if len(pc.slots) > 0 {
+		return true, nil
+	}
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := pc.client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	timer := time.NewTimer(healthCheckTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-reply:
+		return err == nil, nil
+	case <-timer.C:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// removeIdle closes pc and forgets it if it is still pooled and no session is open on it. The
+// sessions opening on pc check that it is still pooled after taking their slot, so it cannot
+// be handed out meanwhile.
+func (p *Pool) removeIdle(pc *pooledClient) {
+	p.mu.Lock()
+	if p.clients[pc.key] != pc || len(pc.slots) > 0 {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.clients, pc.key)
+	p.mu.Unlock()
+	_ = pc.client.Close()
+}
+
+// remove closes pc and forgets it if it is still pooled.
+func (p *Pool) remove(pc *pooledClient) {
+	p.mu.Lock()
+	if p.clients[pc.key] == pc {
+		delete(p.clients, pc.key)
+	}
+	p.mu.Unlock()
+	if pc.client != nil {
+		_ = pc.client.Close()
+	}
+}
+
+func (p *Pool) evictLoop() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.evictIdle()
+		}
+	}
+}
+
+// evictIdle closes the clients without session for longer than the idle timeout.
+func (p *Pool) evictIdle() {
+	idle := make([]*pooledClient, 0)
+	p.mu.Lock()
+	for key, pc := range p.clients {
+		if pc.client != nil && len(pc.slots) == 0 && time.Since(pc.lastUsed) > p.idleTimeout {
+			delete(p.clients, key)
+			idle = append(idle, pc)
+		}
+	}
+	p.mu.Unlock()
+	for _, pc := range idle {
+		_ = pc.client.Close()
+	}
+}
@@ -0,0 +1,216 @@
+package easyssh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPool_Sessions(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	pool := NewPool(2, 0)
+	defer pool.Close()
+	sshConf := s.sshConfig()
+	sshConf.Pool = pool
+	other := s.sshConfig()
+	other.Pool = pool
+
+	gate := make(chan struct{})
+	errs := make(chan error, 2)
+	for _, c := range []*SSHConfig{sshConf, other} {
+		go func(c *SSHConfig) {
+			_, err := c.Exec(context.Background(), "cat", &RunOptions{Stdin: &gatedReader{gate: gate, data: strings.NewReader("x")}})
+			errs <- err
+		}(c)
+	}
+	eventually(t, func() bool { return pool.Stats().SessionsInUse == 2 }, "expected 2 sessions in use")
+
+	// both slots are taken, a third session waits.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := sshConf.Exec(ctx, "echo hi", nil); err != context.DeadlineExceeded {
+		t.Errorf("expected the session to wait for a slot, got %v", err)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{OpenClients: 1, SessionsInUse: 2, Dials: 1}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	close(gate)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if out, _, _, err := sshConf.Run("echo hi", 10); err != nil || out != "hi\n" {
+		t.Errorf("unexpected result: %q %v", out, err)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{OpenClients: 1, SessionsInUse: 0, Dials: 1}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if _, handshakes := s.stats(); handshakes != 1 {
+		t.Errorf("expected 1 handshake, got %d", handshakes)
+	}
+}
+
+func TestPool_Key(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	pool := NewPool(0, 0)
+	defer pool.Close()
+
+	insecure := s.sshConfig()
+	insecure.Pool = pool
+	if _, _, _, err := insecure.Run("echo hi", 10); err != nil {
+		t.Fatal(err)
+	}
+	// the client of insecure is not reused by a config verifying the host key.
+	strict := s.sshConfig()
+	strict.Pool = pool
+	strict.HostKeyPolicy = HostKeyStrict
+	strict.KnownHosts = []string{filepath.Join(os.TempDir(), "easyssh_no_known_hosts")}
+	var unknown *UnknownHostKeyError
+	if _, _, _, err := strict.Run("echo hi", 10); !errors.As(err, &unknown) {
+		t.Errorf("expected *UnknownHostKeyError, got %v", err)
+	}
+	if dials := pool.Stats().Dials; dials != 2 {
+		t.Errorf("expected 2 dials, got %d", dials)
+	}
+}
+
+func TestPool_Redial(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	pool := NewPool(0, 0)
+	defer pool.Close()
+	sshConf := s.sshConfig()
+	sshConf.Pool = pool
+
+	if _, _, _, err := sshConf.Run("echo hi", 10); err != nil {
+		t.Fatal(err)
+	}
+	s.dropConns()
+	eventually(t, func() bool { return pool.Stats().OpenClients == 0 }, "the lost client should be forgotten")
+	if out, _, _, err := sshConf.Run("echo hi", 10); err != nil || out != "hi\n" {
+		t.Errorf("unexpected result: %q %v", out, err)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{OpenClients: 1, Dials: 2}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPool_EvictIdle(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	pool := NewPool(0, 100*time.Millisecond)
+	defer pool.Close()
+	sshConf := s.sshConfig()
+	sshConf.Pool = pool
+
+	// a client running a session is not evicted.
+	gate := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sshConf.Exec(context.Background(), "cat", &RunOptions{Stdin: &gatedReader{gate: gate, data: strings.NewReader("x")}})
+		errs <- err
+	}()
+	eventually(t, func() bool { return pool.Stats().SessionsInUse == 1 }, "expected 1 session in use")
+	time.Sleep(300 * time.Millisecond)
+	close(gate)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, func() bool { return pool.Stats().OpenClients == 0 }, "the idle client should be evicted")
+	eventually(t, func() bool { openConns, _ := s.stats(); return openConns == 0 }, "the idle client should be closed")
+	if _, _, _, err := sshConf.Run("echo hi", 10); err != nil {
+		t.Fatal(err)
+	}
+	if dials := pool.Stats().Dials; dials != 2 {
+		t.Errorf("expected 2 dials, got %d", dials)
+	}
+}
+
+func TestPool_RemovedClient(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	pool := NewPool(0, 0)
+	defer pool.Close()
+	sshConf := s.sshConfig()
+
+	pc, err := pool.get(context.Background(), sshConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.removeIdle(pc)
+	// a session is not opened on a client evicted after it was handed out.
+	if _, err := pool.newSession(context.Background(), pc); err != errClientRemoved {
+		t.Errorf("expected errClientRemoved, got %v", err)
+	}
+	if len(pc.slots) != 0 {
+		t.Error("the slot should be released")
+	}
+}
+
+func TestPool_HealthCheck(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	pool := NewPool(0, 0)
+	defer pool.Close()
+	sshConf := s.sshConfig()
+	sshConf.Pool = pool
+	defer func(timeout time.Duration) { healthCheckTimeout = timeout }(healthCheckTimeout)
+	healthCheckTimeout = 200 * time.Millisecond
+
+	if _, _, _, err := sshConf.Run("echo hi", 10); err != nil {
+		t.Fatal(err)
+	}
+	// the idle client stops answering, it is evicted once the check times out and a new one is dialed.
+	atomic.StoreInt32(&s.silent, 1)
+	if out, _, _, err := sshConf.Run("echo hi", 10); err != nil || out != "hi\n" {
+		t.Errorf("unexpected result: %q %v", out, err)
+	}
+	if stats := pool.Stats(); stats != (PoolStats{OpenClients: 1, Dials: 2}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	eventually(t, func() bool { openConns, _ := s.stats(); return openConns == 1 }, "the silent client should be closed")
+}
+
+func TestPool_HealthCheckCancelled(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	pool := NewPool(0, 0)
+	defer pool.Close()
+	sshConf := s.sshConfig()
+	sshConf.Pool = pool
+
+	if _, _, _, err := sshConf.Run("echo hi", 10); err != nil {
+		t.Fatal(err)
+	}
+	// a caller giving up during the health check gets its context error, the client is kept.
+	atomic.StoreInt32(&s.silent, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := sshConf.RunContext(ctx, "echo hi"); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the health check ignored the context: %s", elapsed)
+	}
+	if stats := pool.Stats(); stats.OpenClients != 1 {
+		t.Errorf("the client should be kept: %+v", stats)
+	}
+
+	atomic.StoreInt32(&s.silent, 0)
+	if out, _, _, err := sshConf.Run("echo hi", 10); err != nil || out != "hi\n" {
+		t.Errorf("unexpected result: %q %v", out, err)
+	}
+	if dials := pool.Stats().Dials; dials != 1 {
+		t.Errorf("expected 1 dial, got %d", dials)
+	}
+}
@@ -0,0 +1,353 @@
+package easyssh
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DialContextFunc connects to addr, it is the signature of net.Dialer.DialContext.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ProxyFromEnvironment dials addr through the proxy named by the ALL_PROXY or else the HTTPS_PROXY
+// environment variable (or their lowercase versions), the hosts listed in NO_PROXY are dialed directly.
+// socks5://, socks5h://, http:// and https:// proxies are supported, a proxy without scheme is an HTTP proxy.
+// Set SSHConfig.DialContext to ProxyFromEnvironment to use it.
+func ProxyFromEnvironment(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxy := getEnvAny("ALL_PROXY", "all_proxy")
+	if proxy == "" {
+		proxy = getEnvAny("HTTPS_PROXY", "https_proxy")
+	}
+	if proxy == "" || !useProxy(addr, getEnvAny("NO_PROXY", "no_proxy")) {
+		return directDial(ctx, network, addr)
+	}
+
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %w", proxy, err)
+	}
+	dial, err := ProxyFromURL(proxyURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return dial(ctx, network, addr)
+}
+
+// ProxyFromURL returns a DialContextFunc connecting through the SOCKS5 (socks5:// resolving the
+// server address locally, socks5h:// letting the proxy resolve it) or HTTP CONNECT (http://, https://)
+// proxy at proxyURL, whose user info is used to authenticate. The proxy itself is dialed with
+// forward, or directly if forward is nil.
+func ProxyFromURL(proxyURL *url.URL, forward DialContextFunc) (DialContextFunc, error) {
+	if forward == nil {
+		forward = directDial
+	}
+	p := &proxyDialer{url: proxyURL, forward: forward}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h":
+		p.defaultPort = "1080"
+		return p.dialSOCKS5, nil
+	case "http":
+		p.defaultPort = "80"
+		return p.dialHTTP, nil
+	case "https":
+		p.defaultPort = "443"
+		return p.dialHTTP, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+}
+
+func directDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func getEnvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// useProxy tells whether addr is not excluded by noProxy, a comma separated list of hosts, domains
+// (example.com and .example.com both match the subdomains too), IPs and CIDRs, or "*".
+func useProxy(addr, noProxy string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return false
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.Trim(entry, "[]")
+		if ip != nil {
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return false
+		}
+	}
+	return true
+}
+
+type proxyDialer struct {
+	url         *url.URL
+	defaultPort string
+	forward     DialContextFunc
+}
+
+// connect dials the proxy and calls handshake with the connection, which is aborted when ctx is done.
+func (p *proxyDialer) connect(ctx context.Context, network string, handshake func(conn net.Conn) (net.Conn, error)) (net.Conn, error) {
+	proxyAddr := p.url.Host
+	if p.url.Port() == "" {
+		proxyAddr = net.JoinHostPort(p.url.Hostname(), p.defaultPort)
+	}
+	conn, err := p.forward(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if p.url.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: p.url.Hostname()})
+	}
+
+	stop := closeOnDone(ctx, func() { _ = conn.Close() })
+	proxied, err := handshake(conn)
+	stop()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy %s error: %w", redactURL(p.url), err)
+	}
+	return proxied, nil
+}
+
+// dialHTTP opens a tunnel to addr with the HTTP CONNECT method.
+func (p *proxyDialer) dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	return p.connect(ctx, network, func(conn net.Conn) (net.Conn, error) {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if user := p.url.User; user != nil {
+			password, _ := user.Password()
+			credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+		if err := req.Write(conn); err != nil {
+			return nil, err
+		}
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+		}
+		if br.Buffered() > 0 {
+			// the server may already have sent its version, don't lose it.
+			return &bufferedConn{Conn: conn, r: br}, nil
+		}
+		return conn, nil
+	})
+}
+
+// redactURL hides the password of u.
+func redactURL(u *url.URL) string {
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return redacted.String()
+}
+
+// bufferedConn is a net.Conn whose first bytes were already read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// socks5 reply codes, RFC 1928
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// dialSOCKS5 opens a tunnel to addr with the SOCKS5 CONNECT command.
+func (p *proxyDialer) dialSOCKS5(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port: %s", addr)
+	}
+	if p.url.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		host = ips[0].IP.String()
+	}
+
+	return p.connect(ctx, network, func(conn net.Conn) (net.Conn, error) {
+		// greeting, offering username/password authentication if the url has credentials.
+		methods := []byte{0x00}
+		if p.url.User != nil {
+			methods = append(methods, 0x02)
+		}
+		if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+			return nil, err
+		}
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[0] != 0x05 {
+			return nil, fmt.Errorf("unexpected SOCKS version: %d", reply[0])
+		}
+		switch reply[1] {
+		case 0x00:
+		case 0x02:
+			if p.url.User == nil {
+				return nil, errors.New("SOCKS proxy requires authentication")
+			}
+			if err := socks5Auth(conn, p.url.User); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.New("no acceptable SOCKS authentication method")
+		}
+
+		req := []byte{0x05, 0x01, 0x00}
+		if ip := net.ParseIP(host); ip == nil {
+			if len(host) > 255 {
+				return nil, fmt.Errorf("host name too long: %s", host)
+			}
+			req = append(req, 0x03, byte(len(host)))
+			req = append(req, host...)
+		} else if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip.To16()...)
+		}
+		req = append(req, byte(port>>8), byte(port))
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+
+		// VER REP RSV ATYP, then the bound address which is of no use here.
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		if header[1] != 0x00 {
+			reason := "unknown error"
+			if int(header[1]) < len(socks5Errors) {
+				reason = socks5Errors[header[1]]
+			}
+			return nil, fmt.Errorf("SOCKS CONNECT %s: %s", addr, reason)
+		}
+		var skip int
+		switch header[3] {
+		case 0x01:
+			skip = net.IPv4len
+		case 0x04:
+			skip = net.IPv6len
+		case 0x03:
+			size := make([]byte, 1)
+			if _, err := io.ReadFull(conn, size); err != nil {
+				return nil, err
+			}
+			skip = int(size[0])
+		default:
+			return nil, fmt.Errorf("unexpected SOCKS address type: %d", header[3])
+		}
+		if _, err := io.CopyN(ioutil.Discard, conn, int64(skip+2)); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// socks5Auth runs the username/password authentication, RFC 1929.
+func socks5Auth(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("SOCKS credentials too long")
+	}
+	req := []byte{0x01, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("SOCKS authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package easyssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// listen serves every connection accepted on a local port with handle.
+func listen(t *testing.T, handle func(conn net.Conn)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return ln
+}
+
+// newGreeter is a server which greets its clients with "hello\n", like an ssh server sending its version.
+func newGreeter(t *testing.T) net.Listener {
+	return listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = conn.Write([]byte("hello\n"))
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// pipe connects the proxy client to addr.
+func pipe(client net.Conn, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go func() { _, _ = io.Copy(target, client) }()
+	_, _ = io.Copy(client, target)
+}
+
+func newHTTPProxy(t *testing.T) net.Listener {
+	return listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic am9objpzZWNyZXQ=" {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, req.Host)
+	})
+}
+
+func newSOCKS5Proxy(t *testing.T) net.Listener {
+	return listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 262)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0x05, 0x02})
+		// username/password
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		_, _ = io.ReadFull(conn, user)
+		_, _ = io.ReadFull(conn, buf[:1])
+		password := make([]byte, buf[0])
+		_, _ = io.ReadFull(conn, password)
+		if string(user) != "john" || string(password) != "secret" {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		_, _ = conn.Write([]byte{0x01, 0x00})
+
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		var host string
+		switch buf[3] {
+		case 0x01:
+			_, _ = io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 0x03:
+			_, _ = io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			_, _ = io.ReadFull(conn, name)
+			host = string(name)
+		}
+		_, _ = io.ReadFull(conn, buf[:2])
+		port := binary.BigEndian.Uint16(buf[:2])
+		_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		pipe(conn, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	})
+}
+
+func TestProxyFromURL(t *testing.T) {
+	greeter := newGreeter(t)
+	defer greeter.Close()
+	_, port, _ := net.SplitHostPort(greeter.Addr().String())
+	httpProxy := newHTTPProxy(t)
+	defer httpProxy.Close()
+	socksProxy := newSOCKS5Proxy(t)
+	defer socksProxy.Close()
+
+	for _, proxy := range []string{
+		"http://john:secret@" + httpProxy.Addr().String(),
+		"socks5://john:secret@" + socksProxy.Addr().String(),
+		"socks5h://john:secret@" + socksProxy.Addr().String(),
+	} {
+		proxyURL, _ := url.Parse(proxy)
+		dial, err := ProxyFromURL(proxyURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dial(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Errorf("%s: %s", proxy, err)
+			continue
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "hello\n" {
+			t.Errorf("%s: unexpected greeting %q, %v", proxy, line, err)
+		}
+		conn.Close()
+	}
+
+	for _, proxy := range []string{
+		"http://john:wrong@" + httpProxy.Addr().String(),
+		"socks5://john:wrong@" + socksProxy.Addr().String(),
+	} {
+		proxyURL, _ := url.Parse(proxy)
+		dial, _ := ProxyFromURL(proxyURL, nil)
+		if conn, err := dial(context.Background(), "tcp", greeter.Addr().String()); err == nil {
+			conn.Close()
+			t.Errorf("%s: wrong credentials accepted", proxy)
+		}
+	}
+
+	if _, err := ProxyFromURL(&url.URL{Scheme: "ftp", Host: "proxy"}, nil); err == nil {
+		t.Error("unsupported scheme should fail")
+	}
+}
+
+func TestUseProxy(t *testing.T) {
+	noProxy := "localhost, .internal.example.com,example.org:22,10.0.0.0/8,[::1]"
+	for addr, want := range map[string]bool{
+		"localhost:22":               false,
+		"db.internal.example.com:22": false,
+		"internal.example.com:22":    false,
+		"example.org:22":             false,
+		"www.example.org:22":         false,
+		"10.1.2.3:22":                false,
+		"[::1]:22":                   false,
+		"example.com:22":             true,
+		"notexample.org:22":          true,
+		"192.168.0.1:22":             true,
+	} {
+		if got := useProxy(addr, noProxy); got != want {
+			t.Errorf("useProxy(%s) = %v", addr, got)
+		}
+	}
+	if useProxy("example.com:22", "*") {
+		t.Error("* should disable the proxy")
+	}
+}
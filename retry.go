@@ -0,0 +1,115 @@
+package easyssh
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RetryPolicy tells how dialing and idempotent operations, uploads, downloads and the commands
+// run with RunOptions.Idempotent, are retried after transient failures.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one, 1 or less disables retries.
+	MaxAttempts int
+	// The delay before the nth retry is InitialBackoff*2^(n-1), at most MaxBackoff, minus a random
+	// jitter of up to half of it. They default to 1 and 30 seconds.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Retryable tells whether an error is transient, IsRetryable by default.
+	Retryable func(err error) bool
+}
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// IsRetryable reports whether err is a transient network failure: a timeout, a refused, reset or
+// aborted connection, a connection closed by the server or lost for lack of keepalive answers,
+// or a command interrupted before it reported its exit status.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, ErrKeepAliveTimeout) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var missing *ssh.ExitMissingError
+	if errors.As(err, &missing) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// the ssh package flattens the handshake errors into strings.
+	msg := err.Error()
+	return strings.HasPrefix(msg, "ssh: handshake failed: ") &&
+		(strings.HasSuffix(msg, ": EOF") || strings.Contains(msg, "connection reset by peer") || strings.Contains(msg, "i/o timeout"))
+}
+
+// retryingKey marks the contexts of the operations being retried, so that the dials they
+// make are not retried on their own as well.
+type retryingKey struct{}
+
+// retry calls fn until it succeeds, fails with an error which is not retryable or the attempts
+// are exhausted. fn is called once if there is no retry policy, or if retry is nested in another retry.
+func (sshConf *SSHConfig) retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	policy := sshConf.Retry
+	if policy == nil || policy.MaxAttempts <= 1 || ctx.Value(retryingKey{}) != nil {
+		return fn(ctx)
+	}
+	ctx = context.WithValue(ctx, retryingKey{}, true)
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || attempt >= policy.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// backoff returns the delay before the given retry, counted from 1.
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = defaultInitialBackoff
+	}
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff - time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
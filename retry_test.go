@@ -0,0 +1,97 @@
+package easyssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRetry(t *testing.T) {
+	sshConf := &SSHConfig{Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}}
+	reset := fmt.Errorf("read: %w", syscall.ECONNRESET)
+
+	calls := 0
+	err := sshConf.retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		return reset
+	})
+	if err != reset || calls != 3 {
+		t.Errorf("expected 3 attempts, got %d: %v", calls, err)
+	}
+
+	calls = 0
+	err = sshConf.retry(context.Background(), func(ctx context.Context) error {
+		if calls++; calls < 2 {
+			return reset
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("expected success on the second attempt, got %d: %v", calls, err)
+	}
+
+	calls = 0
+	denied := errors.New("ssh: handshake failed: ssh: unable to authenticate")
+	if err = sshConf.retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		return denied
+	}); err != denied || calls != 1 {
+		t.Errorf("non retryable error should not be retried, got %d: %v", calls, err)
+	}
+
+	// nested retries, like the dials of an upload, run once.
+	calls = 0
+	_ = sshConf.retry(context.Background(), func(ctx context.Context) error {
+		return sshConf.retry(ctx, func(ctx context.Context) error {
+			calls++
+			return reset
+		})
+	})
+	if calls != 3 {
+		t.Errorf("nested retry should run once per attempt, got %d calls", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	slow := &SSHConfig{Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}}
+	if err = slow.retry(ctx, func(ctx context.Context) error {
+		cancel()
+		return reset
+	}); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for retry, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 10: time.Second} {
+		for i := 0; i < 20; i++ {
+			if backoff := policy.backoff(retry); backoff < max/2 || backoff > max {
+				t.Errorf("backoff(%d) = %s, expected between %s and %s", retry, backoff, max/2, max)
+			}
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for err, want := range map[error]bool{
+		fmt.Errorf("dial: %w", syscall.ECONNREFUSED): true,
+		ErrKeepAliveTimeout:                          true,
+		io.EOF:                                       true,
+		&ExitError{Result: &Result{}, Err: &ssh.ExitMissingError{}}:      true,
+		errors.New("ssh: handshake failed: EOF"):                         true,
+		errors.New("ssh: handshake failed: ssh: unable to authenticate"): false,
+		&ExitError{Result: &Result{}, Err: errors.New("exit 1")}:         false,
+		context.DeadlineExceeded:                                         false,
+		&UnknownHostKeyError{}:                                           false,
+	} {
+		if got := IsRetryable(err); got != want {
+			t.Errorf("IsRetryable(%v) = %v", err, got)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package easyssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process ssh server accepting the password "secret", close it once done.
+// Its commands are implemented in Go by testSession.exec, so that the tests run without a shell:
+//
+//	echo <text>  prints text
+//	exit <n>     exits with status n
+//	cat          copies stdin to stdout, like the login shell
+//	sleep        runs until the session is closed or a signal is received
+//	trap         like sleep, but exits with status 130 after printing "trapped <signal>"
+//	hang         like sleep, ignoring signals
+//	flood        prints "flood" lines until the session is closed, ignoring signals
+type testServer struct {
+	addr string
+	ln   net.Listener
+
+	// maxSessions rejects the sessions beyond it on each connection, like MaxSessions of OpenSSH.
+	maxSessions int
+	// silent holds the answers to global requests, like keepalives, while set to 1.
+	silent int32
+	// stalled stops reading the connections while set to 1, the commands go on.
+	stalled int32
+	// sessions counts the sessions open on all the connections.
+	sessions int32
+
+	mu          sync.Mutex
+	conns       []net.Conn
+	openConns   int
+	handshakes  int
+	ptys        []testPTY
+	signals     []string
+	directTCPIP []string
+}
+
+// testPTY is a pty-req received by the testServer.
+type testPTY struct {
+	Term          string
+	Width, Height uint32
+	Modes         ssh.TerminalModes
+}
+
+func startTestServer(t *testing.T) *testServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, fmt.Errorf("wrong password for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{addr: ln.Addr().String(), ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+// sshConfig returns an SSHConfig logging into s.
+func (s *testServer) sshConfig() *SSHConfig {
+	host, port, _ := net.SplitHostPort(s.addr)
+	return &SSHConfig{User: "john", Server: host, Port: port, Password: "secret", HostKeyPolicy: HostKeyInsecure, DisableAgent: true}
+}
+
+func (s *testServer) close() {
+	_ = s.ln.Close()
+	s.dropConns()
+}
+
+// dropConns closes the connections of the clients, as a server restart would.
+func (s *testServer) dropConns() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// stats returns the connections open and handshakes made so far.
+func (s *testServer) stats() (openConns, handshakes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.openConns, s.handshakes
+}
+
+func (s *testServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	s.mu.Lock()
+	s.conns = append(s.conns, conn)
+	s.openConns++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.openConns--
+		s.mu.Unlock()
+	}()
+
+	serverConn, chans, reqs, err := ssh.NewServerConn(&stallConn{Conn: conn, stalled: &s.stalled}, config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	s.mu.Lock()
+	s.handshakes++
+	s.mu.Unlock()
+
+	closed := make(chan struct{})
+	go func() {
+		_ = serverConn.Wait()
+		close(closed)
+	}()
+	go func() {
+		for req := range reqs {
+			// a silent server answers late, if ever.
+			for atomic.LoadInt32(&s.silent) != 0 {
+				select {
+				case <-closed:
+					return
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			_ = req.Reply(req.Type == "keepalive@openssh.com", nil)
+		}
+	}()
+
+	var sessions int32
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			if s.maxSessions > 0 && !acquireSession(&sessions, s.maxSessions) {
+				_ = newChannel.Reject(ssh.Prohibited, "no more sessions")
+				continue
+			}
+			ch, chReqs, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			atomic.AddInt32(&s.sessions, 1)
+			go func() {
+				s.session(ch, chReqs)
+				atomic.AddInt32(&sessions, -1)
+				atomic.AddInt32(&s.sessions, -1)
+			}()
+		case "direct-tcpip":
+			s.directTCP(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, newChannel.ChannelType())
+		}
+	}
+}
+
+// acquireSession counts a new session unless max are open. The sessions closed by the client
+// just before are given a moment to be counted out, the session goroutines notice the close
+// asynchronously while sshd handles the messages of a connection in order.
+func acquireSession(sessions *int32, max int) bool {
+	for i := 0; i < 100; i++ {
+		if n := atomic.LoadInt32(sessions); int(n) < max {
+			if atomic.CompareAndSwapInt32(sessions, n, n+1) {
+				return true
+			}
+			continue
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func (s *testServer) directTCP(newChannel ssh.NewChannel) {
+	var target struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	addr := net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port)))
+	s.mu.Lock()
+	s.directTCPIP = append(s.directTCPIP, addr)
+	s.mu.Unlock()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		_, _ = io.Copy(ch, conn)
+		_ = ch.CloseWrite()
+	}()
+	go func() {
+		_, _ = io.Copy(conn, ch)
+		_ = conn.Close()
+	}()
+}
+
+// stallConn stops reading while stalled is set to 1.
+type stallConn struct {
+	net.Conn
+	stalled *int32
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	for atomic.LoadInt32(c.stalled) != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.Conn.Read(p)
+}
+
+// testSession is a command run by the testServer.
+type testSession struct {
+	command string
+	ch      ssh.Channel
+	signals chan string
+	closed  chan struct{} // closed once the client closes the session
+}
+
+func (s *testServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	ts := &testSession{ch: ch, signals: make(chan string, 8), closed: make(chan struct{})}
+	defer close(ts.closed)
+	started := false
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			var pty struct {
+				Term                string
+				Width, Height, X, Y uint32
+				Modes               string
+			}
+			if err := ssh.Unmarshal(req.Payload, &pty); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			s.mu.Lock()
+			s.ptys = append(s.ptys, testPTY{Term: pty.Term, Width: pty.Width, Height: pty.Height, Modes: parseModes(pty.Modes)})
+			s.mu.Unlock()
+			_ = req.Reply(true, nil)
+		case "env", "window-change":
+			_ = req.Reply(true, nil)
+		case "signal":
+			var sig struct{ Signal string }
+			_ = ssh.Unmarshal(req.Payload, &sig)
+			s.mu.Lock()
+			s.signals = append(s.signals, sig.Signal)
+			s.mu.Unlock()
+			select {
+			case ts.signals <- sig.Signal:
+			default:
+			}
+		case "exec", "shell":
+			if started {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			var exec struct{ Command string }
+			if req.Type == "exec" {
+				_ = ssh.Unmarshal(req.Payload, &exec)
+			}
+			ts.command = exec.Command
+			started = true
+			_ = req.Reply(true, nil)
+			go ts.run()
+		default:
+			_ = req.Reply(false, nil)
+		}
+	}
+}
+
+// run runs the command and reports its exit status or signal.
+func (ts *testSession) run() {
+	status, signal := ts.exec()
+	if signal != "" {
+		_, _ = ts.ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{Signal: signal}))
+	} else {
+		_, _ = ts.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	}
+	_ = ts.ch.Close()
+}
+
+func (ts *testSession) exec() (status int, signal string) {
+	name, arg := ts.command, ""
+	if i := strings.IndexByte(ts.command, ' '); i >= 0 {
+		name, arg = ts.command[:i], ts.command[i+1:]
+	}
+	switch name {
+	case "echo":
+		_, _ = fmt.Fprintln(ts.ch, arg)
+	case "exit":
+		status, _ = strconv.Atoi(arg)
+	case "", "cat":
+		_, _ = io.Copy(ts.ch, ts.ch)
+	case "sleep", "trap", "hang":
+		for {
+			select {
+			case <-ts.closed:
+				return 0, "HUP"
+			case sig := <-ts.signals:
+				switch name {
+				case "sleep":
+					return 0, sig
+				case "trap":
+					_, _ = fmt.Fprintln(ts.ch, "trapped", sig)
+					return 130, ""
+				}
+			}
+		}
+	case "flood":
+		for {
+			if _, err := fmt.Fprintln(ts.ch, "flood"); err != nil {
+				return 0, "HUP"
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	default:
+		_, _ = fmt.Fprintln(ts.ch.Stderr(), name+": command not found")
+		status = 127
+	}
+	return status, ""
+}
+
+// parseModes decodes the terminal modes of a pty-req.
+func parseModes(modes string) ssh.TerminalModes {
+	parsed := ssh.TerminalModes{}
+	for i := 0; i+5 <= len(modes) && modes[i] != 0; i += 5 {
+		b := modes[i+1 : i+5]
+		parsed[modes[i]] = uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+	return parsed
+}
+
+// eventually polls cond for up to 5 seconds.
+func eventually(t *testing.T, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
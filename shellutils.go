@@ -13,7 +13,15 @@ import (
 // https://studygolang.com/articles/4004   <- run shell command and read output line by line
 // https://studygolang.com/articles/7767   <- run command without known args
 func Local(localCmd string, paras ...interface{}) (out string, err error) {
-	localCmd = fmt.Sprintf(localCmd, paras...)
+	return local(fmt.Sprintf(localCmd, paras...))
+}
+
+// LocalCommand is like Local, running the command line built by cmd.
+func LocalCommand(cmd *Cmd) (out string, err error) {
+	return local(cmd.String())
+}
+
+func local(localCmd string) (out string, err error) {
 	cmd := exec.Command("/bin/bash", "-c", localCmd)
 	ret, err := cmd.CombinedOutput()
 	out = string(ret)
@@ -65,7 +73,7 @@ func Tar(tgzPath, targetPath string) error {
 
 	targetPathDir := filepath.Dir(RemoveTrailingSlash(targetPath))
 	target := filepath.Base(RemoveTrailingSlash(targetPath))
-	_, err := Local("tar czf %s -C %s %s", tgzPath, targetPathDir, target)
+	_, err := LocalCommand(Command("tar", "czf", tgzPath, "-C", targetPathDir, target))
 	return err
 }
 
@@ -79,6 +87,6 @@ func UnTar(tgzPath, targetPath string) error {
 		return errors.New("tar path invalid: " + tgzPath)
 	}
 
-	_, err := Local("tar xf %s -C %s", tgzPath, targetPath)
+	_, err := LocalCommand(Command("tar", "xf", tgzPath, "-C", targetPath))
 	return err
 }
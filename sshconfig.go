@@ -0,0 +1,372 @@
+package easyssh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxIncludeDepth bounds nested Include and ProxyJump lookups, like OpenSSH does.
+const maxIncludeDepth = 16
+
+// FromSSHConfig returns the SSHConfig of host as configured in ~/.ssh/config and /etc/ssh/ssh_config,
+// so that host can be any name accepted by ssh, like an alias declared with Host.
+// HostName, User, Port, IdentityFile, ProxyJump, ConnectTimeout, UserKnownHostsFile and
+// StrictHostKeyChecking are used, the other keywords are ignored.
+func FromSSHConfig(host string) (*SSHConfig, error) {
+	files := []string{"/etc/ssh/ssh_config"}
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append([]string{filepath.Join(home, ".ssh", "config")}, files...)
+	}
+	return FromSSHConfigFile(host, files...)
+}
+
+// FromSSHConfigFile is like FromSSHConfig reading the given OpenSSH config files, in order.
+// Files that do not exist are skipped.
+func FromSSHConfigFile(host string, files ...string) (*SSHConfig, error) {
+	return fromSSHConfigFiles(host, files, 0)
+}
+
+func fromSSHConfigFiles(host string, files []string, depth int) (*SSHConfig, error) {
+	p := &sshConfigParser{host: host, values: make(map[string][]string)}
+	for _, file := range files {
+		if !IsFileExists(file) {
+			continue
+		}
+		if err := p.parseFile(file, filepath.Dir(file), 0); err != nil {
+			return nil, err
+		}
+	}
+	return p.sshConfig(files, depth)
+}
+
+// sshConfigParser collects the options applying to host, the first value of each keyword wins
+// except for IdentityFile which accumulates.
+type sshConfigParser struct {
+	host          string
+	values        map[string][]string
+	identityFiles []string
+}
+
+func (p *sshConfigParser) parseFile(path, baseDir string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("ssh config: too many nested Include in %s", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer Close(f)
+
+	active := true
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		keyword, args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("ssh config %s:%d: %w", path, lineNo, err)
+		}
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			active = matchPatternList(p.host, args)
+		case "match":
+			if active, err = p.match(args); err != nil {
+				return fmt.Errorf("ssh config %s:%d: %w", path, lineNo, err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("ssh config %s:%d: %w", path, lineNo, err)
+				}
+				for _, include := range matches {
+					if err := p.parseFile(include, baseDir, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			if !active || len(args) == 0 {
+				continue
+			}
+			if keyword == "identityfile" {
+				p.identityFiles = append(p.identityFiles, args[0])
+			} else if _, ok := p.values[keyword]; !ok {
+				p.values[keyword] = args
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// match evaluates the criteria of a Match line, only all, host, originalhost and user are supported,
+// the blocks using other criteria never apply. host is matched against HostName if it is already set.
+func (p *sshConfigParser) match(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, fmt.Errorf("missing Match criteria")
+	}
+	for i := 0; i < len(args); i++ {
+		criteria := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criteria, "!")
+		criteria = strings.TrimPrefix(criteria, "!")
+		switch criteria {
+		case "all":
+			if negate {
+				return false, nil
+			}
+			continue
+		case "canonical", "final":
+			// there is no canonicalization nor final pass.
+			if !negate {
+				return false, nil
+			}
+			continue
+		}
+		if i+1 >= len(args) {
+			return false, fmt.Errorf("missing argument for Match %s", criteria)
+		}
+		i++
+		patterns := strings.Split(args[i], ",")
+
+		var matched bool
+		switch criteria {
+		case "host":
+			host := p.host
+			if hostname, ok := p.values["hostname"]; ok {
+				host = expandHostTokens(hostname[0], p.host)
+			}
+			matched = matchPatternList(host, patterns)
+		case "originalhost":
+			matched = matchPatternList(p.host, patterns)
+		case "user":
+			user := currentUser()
+			if u, ok := p.values["user"]; ok {
+				user = u[0]
+			}
+			matched = matchPatternList(user, patterns)
+		default:
+			return false, nil
+		}
+		if matched == negate {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sshConfig builds the SSHConfig of host from the collected options.
+func (p *sshConfigParser) sshConfig(files []string, depth int) (*SSHConfig, error) {
+	sshConf := &SSHConfig{Server: p.host}
+	if v, ok := p.values["hostname"]; ok {
+		sshConf.Server = expandHostTokens(v[0], p.host)
+	}
+	if v, ok := p.values["user"]; ok {
+		sshConf.User = v[0]
+	}
+	if v, ok := p.values["port"]; ok {
+		sshConf.Port = v[0]
+	}
+	if v, ok := p.values["connecttimeout"]; ok && v[0] != "none" {
+		timeout, err := strconv.Atoi(v[0])
+		if err != nil {
+			return nil, fmt.Errorf("ssh config: invalid ConnectTimeout: %s", v[0])
+		}
+		sshConf.Timeout = timeout
+	}
+
+	// like ssh, identity files which do not exist are skipped.
+	for _, identityFile := range p.identityFiles {
+		identityFile = expandHome(expandTokens(identityFile, sshConf))
+		if !IsFileExists(identityFile) {
+			continue
+		}
+		if sshConf.Key == "" {
+			sshConf.Key = identityFile
+		} else {
+			sshConf.Keys = append(sshConf.Keys, identityFile)
+		}
+	}
+
+	if v, ok := p.values["userknownhostsfile"]; ok && v[0] != "none" {
+		for _, file := range v {
+			sshConf.KnownHosts = append(sshConf.KnownHosts, expandHome(expandTokens(file, sshConf)))
+		}
+	}
+	if v, ok := p.values["stricthostkeychecking"]; ok {
+		switch strings.ToLower(v[0]) {
+		case "yes", "ask":
+			sshConf.HostKeyPolicy = HostKeyStrict
+		case "accept-new":
+			sshConf.HostKeyPolicy = HostKeyTOFU
+		case "no", "off":
+			sshConf.HostKeyPolicy = HostKeyInsecure
+		default:
+			return nil, fmt.Errorf("ssh config: invalid StrictHostKeyChecking: %s", v[0])
+		}
+	}
+
+	if v, ok := p.values["proxyjump"]; ok && v[0] != "none" {
+		if depth >= maxIncludeDepth {
+			return nil, fmt.Errorf("ssh config: too many nested ProxyJump for %s", p.host)
+		}
+		// the jump hosts are looked up in the config files as well.
+		for _, jump := range strings.Split(v[0], ",") {
+			target, err := Parse(strings.TrimSpace(jump))
+			if err != nil {
+				return nil, fmt.Errorf("ssh config: invalid ProxyJump: %w", err)
+			}
+			jumpConf, err := fromSSHConfigFiles(target.Server, files, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if target.User != "" {
+				jumpConf.User = target.User
+			}
+			if target.Port != "" {
+				jumpConf.Port = target.Port
+			}
+			sshConf.JumpHosts = append(sshConf.JumpHosts, jumpConf)
+		}
+	}
+	return sshConf, nil
+}
+
+// expandTokens replaces the %d, %h, %p, %r, %u and %% tokens of the IdentityFile and UserKnownHostsFile values.
+func expandTokens(s string, sshConf *SSHConfig) string {
+	home, _ := os.UserHomeDir()
+	port := sshConf.Port
+	if port == "" {
+		port = "22"
+	}
+	remoteUser := sshConf.User
+	if remoteUser == "" {
+		remoteUser = currentUser()
+	}
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", sshConf.Server,
+		"%p", port,
+		"%r", remoteUser,
+		"%u", currentUser(),
+	).Replace(s)
+}
+
+// expandHostTokens replaces the %h and %% tokens of HostName.
+func expandHostTokens(hostname, host string) string {
+	return strings.NewReplacer("%%", "%", "%h", host).Replace(hostname)
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// splitConfigLine returns the lowercase keyword of an ssh config line and its arguments, which
+// can be double quoted. The keyword is empty for blank lines and comments.
+func splitConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	args := make([]string, 0)
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" || strings.HasPrefix(rest, "#") {
+			return keyword, args, nil
+		}
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated quote: %s", line)
+			}
+			args = append(args, rest[1:end+1])
+			rest = rest[end+2:]
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+}
+
+// matchPatternList tells whether s matches one of the patterns and none of the negated (!) ones.
+func matchPatternList(s string, patterns []string) bool {
+	s = strings.ToLower(s)
+	matched := false
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(s, pattern[1:]) {
+				return false
+			}
+		} else if matchPattern(s, pattern) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// matchPattern matches s against an ssh config pattern, where * matches any run of characters and ? one character.
+func matchPattern(s, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(s[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s, pattern = s[1:], pattern[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,104 @@
+package easyssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFromSSHConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "easyssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := filepath.Join(dir, "id_prod")
+	if err := ioutil.WriteFile(key, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(config, []byte(`
+Include conf.d/*
+
+# production
+Host prod-db prod-db-replica
+  HostName db.prod.internal
+  Port 2222
+  IdentityFile "`+key+`"
+  IdentityFile `+filepath.Join(dir, "missing")+`
+  ProxyJump jump@bastion:2200
+
+Match host *.prod.internal
+  User dba
+  ConnectTimeout=7
+
+Host *.example.com !secret.example.com
+  User web
+
+Host *
+  User nobody
+  StrictHostKeyChecking accept-new
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "conf.d", "bastion"), []byte(`
+Host bastion
+  HostName bastion.example.com
+  User admin
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sshConf, err := FromSSHConfigFile("prod-db", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sshConf.Server != "db.prod.internal" || sshConf.Port != "2222" || sshConf.User != "dba" ||
+		sshConf.Timeout != 7 || sshConf.Key != key || len(sshConf.Keys) != 0 || sshConf.HostKeyPolicy != HostKeyTOFU {
+		t.Errorf("unexpected config: %+v", sshConf)
+	}
+	if len(sshConf.JumpHosts) != 1 {
+		t.Fatalf("expected 1 jump host, got %d", len(sshConf.JumpHosts))
+	}
+	if jump := sshConf.JumpHosts[0]; jump.Server != "bastion.example.com" || jump.User != "jump" || jump.Port != "2200" {
+		t.Errorf("unexpected jump host: %+v", jump)
+	}
+
+	for host, user := range map[string]string{
+		"www.example.com":    "web",
+		"secret.example.com": "nobody",
+		"other":              "nobody",
+	} {
+		sshConf, err := FromSSHConfigFile(host, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sshConf.Server != host || sshConf.User != user {
+			t.Errorf("%s: unexpected config: %+v", host, sshConf)
+		}
+	}
+}
+
+func TestSplitConfigLine(t *testing.T) {
+	for line, want := range map[string][]string{
+		"HostName example.com":               {"hostname", "example.com"},
+		"  Port=22":                          {"port", "22"},
+		"User = john":                        {"user", "john"},
+		`IdentityFile "/my keys/id_rsa" # x`: {"identityfile", "/my keys/id_rsa"},
+		"Host a b\t c":                       {"host", "a", "b", "c"},
+	} {
+		keyword, args, err := splitConfigLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := append([]string{keyword}, args...); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitConfigLine(%q) = %q", line, got)
+		}
+	}
+}
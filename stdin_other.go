@@ -0,0 +1,39 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package easyssh
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// stdinReader reads f until stop is called. f cannot be polled here, a read blocking when stop is
+// called still consumes the next input, like the first keystroke typed after the remote shell exits.
+type stdinReader struct {
+	f       *os.File
+	mu      sync.Mutex
+	stopped bool
+}
+
+func newStdinReader(f *os.File) *stdinReader {
+	return &stdinReader{f: f}
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	stopped := r.stopped
+	r.mu.Unlock()
+	if stopped {
+		return 0, io.EOF
+	}
+	return r.f.Read(p)
+}
+
+// stop makes the reader return io.EOF once the read in progress, if any, returns.
+func (r *stdinReader) stop() {
+	r.mu.Lock()
+	r.stopped = true
+	r.mu.Unlock()
+}
@@ -0,0 +1,61 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package easyssh
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// stdinReader reads f until stop is called, it polls f rather than blocking in read so that no input
+// is consumed once stop returns, like the keystrokes typed after the remote shell exits.
+type stdinReader struct {
+	fd      int
+	mu      sync.Mutex
+	stopped bool
+}
+
+func newStdinReader(f *os.File) *stdinReader {
+	return &stdinReader{fd: int(f.Fd())}
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	for {
+		r.mu.Lock()
+		if r.stopped {
+			r.mu.Unlock()
+			return 0, io.EOF
+		}
+		ready, err := unix.Poll([]unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN}}, 100)
+		if err != nil && err != unix.EINTR {
+			r.mu.Unlock()
+			return 0, err
+		}
+		if ready > 0 {
+			n, err := unix.Read(r.fd, p)
+			r.mu.Unlock()
+			if err == unix.EAGAIN {
+				continue
+			}
+			if n <= 0 && err == nil {
+				return 0, io.EOF
+			}
+			if n < 0 {
+				n = 0
+			}
+			return n, err
+		}
+		r.mu.Unlock()
+	}
+}
+
+// stop makes the reader return io.EOF, a read in progress is over once it returns.
+func (r *stdinReader) stop() {
+	r.mu.Lock()
+	r.stopped = true
+	r.mu.Unlock()
+}
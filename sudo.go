@@ -0,0 +1,231 @@
+package easyssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sudoPrompt is the password prompt given to sudo, so that it can be told apart from the output.
+const sudoPrompt = "[easyssh] sudo password: "
+
+// SudoOptions tunes the execution of a command by Sudo, a nil *SudoOptions is valid.
+type SudoOptions struct {
+	// RunOptions of the command, it is always run in a pseudo terminal so its stderr is merged into
+	// stdout. Stdin is not supported as sudo reads the password from the terminal. Dir, Umask and Env
+	// apply to the command run by sudo, Env is always exported by the shell.
+	RunOptions
+	// User to run the command as, root by default.
+	User string
+	// Login runs the command in a login shell of User, like sudo -i.
+	Login bool
+}
+
+// SudoPasswordError is returned by Sudo when sudo asks for a password and none is configured,
+// or rejects the password given. Result holds the output of sudo.
+type SudoPasswordError struct {
+	Result *Result
+	// Missing tells that sudo asked for a password but none is configured.
+	Missing bool
+}
+
+func (e *SudoPasswordError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("%s: sudo password required", e.Result.Command)
+	}
+	return fmt.Sprintf("%s: wrong sudo password", e.Result.Command)
+}
+
+// Sudo runs command with sudo on remote machine and returns its Result, opts may be nil.
+// The password prompt of sudo is answered with SudoPassword, SudoPasswordCallback or Password, and
+// removed from the output. A rejected or missing password is reported as a *SudoPasswordError,
+// the other failures like Exec does.
+func (sshConf *SSHConfig) Sudo(command string, opts *SudoOptions) (*Result, error) {
+	return sshConf.SudoContext(context.Background(), command, opts)
+}
+
+// SudoContext is like Sudo, the command is stopped if ctx is done before it exits.
+func (sshConf *SSHConfig) SudoContext(ctx context.Context, command string, opts *SudoOptions) (*Result, error) {
+	o := SudoOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Stdin != nil {
+		return nil, errors.New("sudo: Stdin is not supported, the terminal answers the password prompt")
+	}
+	sudoCmd, err := sudoCommand(command, &o)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dir, Umask and Env are applied by sudoCommand, sudo would reset them otherwise.
+	runOpts := o.RunOptions
+	runOpts.Dir, runOpts.Umask, runOpts.Env = "", "", nil
+	pty := PTY{}
+	if runOpts.PTY != nil {
+		pty = *runOpts.PTY
+	}
+	if pty.Modes == nil {
+		// no echo nor \r\n translation, the output is the one of the command.
+		pty.Modes = ssh.TerminalModes{ssh.ECHO: 0, ssh.ONLCR: 0, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	}
+	runOpts.PTY = &pty
+	var stdoutBuf bytes.Buffer
+	stdout := o.Stdout
+	if stdout == nil {
+		stdout = &stdoutBuf
+	}
+
+	var result *Result
+	err = sshConf.attempt(ctx, &runOpts, func(ctx context.Context) error {
+		result = nil
+		stdoutBuf.Reset()
+		stdinReader, stdin := io.Pipe()
+		defer stdin.Close()
+		// promptErr is set by the output copy, before wait returns.
+		var promptErr error
+		prompts := 0
+		w := &sudoWriter{w: stdout, onPrompt: func() {
+			// sudo asks again after a wrong password, it is then interrupted.
+			if prompts++; prompts > 1 {
+				promptErr = &SudoPasswordError{}
+				abortSudo(stdin)
+				return
+			}
+			password, err := sshConf.sudoPassword()
+			if err != nil {
+				promptErr = fmt.Errorf("sudo password callback error: %w", err)
+				abortSudo(stdin)
+				return
+			}
+			if password == "" {
+				promptErr = &SudoPasswordError{Missing: true}
+				abortSudo(stdin)
+				return
+			}
+			go func() { _, _ = io.WriteString(stdin, password+"\n") }()
+		}}
+
+		runOpts.Stdin, runOpts.Stdout = stdinReader, w
+		p, err := sshConf.start(ctx, sudoCmd, &runOpts)
+		if err != nil {
+			return err
+		}
+		result, err = p.wait()
+		w.flush()
+		result.Stdout = stdoutBuf.String()
+		var passwordErr *SudoPasswordError
+		if errors.As(promptErr, &passwordErr) {
+			passwordErr.Result = result
+		}
+		if promptErr != nil {
+			return promptErr
+		}
+		return err
+	})
+	return result, err
+}
+
+// sudoCommand wraps command into a sudo command line, the command is run by sh -c in Dir with Umask
+// and Env, as sudo resets the environment and moves to the home of User with Login.
+func sudoCommand(command string, opts *SudoOptions) (string, error) {
+	prefix, err := opts.shellPrefix(nil)
+	if err != nil {
+		return "", err
+	}
+	cmd := Command("sudo", "-p", sudoPrompt)
+	if opts.User != "" {
+		cmd.Arg("-u", opts.User)
+	}
+	if opts.Login {
+		cmd.Arg("-i")
+	}
+	return cmd.Arg("--", "sh", "-c", prefix+command).String(), nil
+}
+
+// sudoPassword returns the password answering the sudo prompt, empty if there is none.
+func (sshConf *SSHConfig) sudoPassword() (string, error) {
+	if sshConf.SudoPassword != "" {
+		return sshConf.SudoPassword, nil
+	}
+	if sshConf.SudoPasswordCallback != nil {
+		return sshConf.SudoPasswordCallback()
+	}
+	return sshConf.Password, nil
+}
+
+// abortSudo interrupts sudo waiting for a password, with ^C on the terminal and EOF.
+func abortSudo(stdin *io.PipeWriter) {
+	go func() {
+		_, _ = io.WriteString(stdin, "\x03")
+		_ = stdin.Close()
+	}()
+}
+
+// sudoWriter copies the output of sudo to w without the password prompts and the new line which
+// follows the password, onPrompt is called for each prompt.
+type sudoWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	onPrompt func()
+	// buf holds the end of the output which may be the beginning of a prompt.
+	buf         []byte
+	skipNewline bool
+	err         error
+}
+
+func (w *sudoWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for {
+		if w.skipNewline && len(w.buf) > 0 {
+			w.skipNewline = false
+			if w.buf[0] == '\n' {
+				w.buf = w.buf[1:]
+			}
+		}
+		i := bytes.Index(w.buf, []byte(sudoPrompt))
+		if i < 0 {
+			break
+		}
+		w.write(w.buf[:i])
+		w.buf = w.buf[i+len(sudoPrompt):]
+		w.skipNewline = true
+		w.onPrompt()
+	}
+
+	// keep the longest suffix which could start a prompt.
+	keep := 0
+	for n := len(sudoPrompt) - 1; n > 0; n-- {
+		if n <= len(w.buf) && bytes.HasSuffix(w.buf, []byte(sudoPrompt[:n])) {
+			keep = n
+			break
+		}
+	}
+	w.write(w.buf[:len(w.buf)-keep])
+	w.buf = append(w.buf[:0], w.buf[len(w.buf)-keep:]...)
+	return len(p), w.err
+}
+
+func (w *sudoWriter) write(p []byte) {
+	if len(p) > 0 && w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+}
+
+// flush writes what is left of the output.
+func (w *sudoWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.write(w.buf)
+	w.buf = nil
+}
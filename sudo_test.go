@@ -0,0 +1,51 @@
+package easyssh
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSudoCommand(t *testing.T) {
+	tests := []struct {
+		opts SudoOptions
+		want string
+	}{
+		{SudoOptions{}, `sudo -p '[easyssh] sudo password: ' -- sh -c 'systemctl restart nginx'`},
+		{SudoOptions{User: "www-data", Login: true}, `sudo -p '[easyssh] sudo password: ' -u www-data -i -- sh -c 'systemctl restart nginx'`},
+		// Dir, Umask and Env are applied inside sudo, which resets them.
+		{SudoOptions{RunOptions: RunOptions{Dir: "/srv/app", Umask: "027", Env: map[string]string{"APP_ENV": "prod"}}, Login: true},
+			`sudo -p '[easyssh] sudo password: ' -i -- sh -c 'cd /srv/app || exit; umask 027 || exit; export APP_ENV=prod; systemctl restart nginx'`},
+	}
+	for _, test := range tests {
+		if got, err := sudoCommand("systemctl restart nginx", &test.opts); err != nil || got != test.want {
+			t.Errorf("got %s %v, want %s", got, err, test.want)
+		}
+	}
+	if got, _ := sudoCommand("echo 'hi'", &SudoOptions{}); got != `sudo -p '[easyssh] sudo password: ' -- sh -c 'echo '\''hi'\'''` {
+		t.Errorf("unexpected quoting: %s", got)
+	}
+	if _, err := sudoCommand("true", &SudoOptions{RunOptions: RunOptions{Umask: "0; rm -rf /"}}); err == nil {
+		t.Error("invalid umask should fail")
+	}
+}
+
+func TestSudoWriter(t *testing.T) {
+	var out bytes.Buffer
+	prompts := 0
+	w := &sudoWriter{w: &out, onPrompt: func() { prompts++ }}
+	output := "before\n" + sudoPrompt + "\nSorry, try again.\n" + sudoPrompt + "\nafter [easyssh] sudo"
+	// written byte by byte so that the prompts are split
+	for i := 0; i < len(output); i++ {
+		if _, err := w.Write([]byte{output[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.flush()
+
+	if prompts != 2 {
+		t.Errorf("expected 2 prompts, got %d", prompts)
+	}
+	if want := "before\nSorry, try again.\nafter [easyssh] sudo"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
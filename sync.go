@@ -1,6 +1,7 @@
 package easyssh
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gaols/goutils"
@@ -12,10 +13,24 @@ import (
 	"time"
 )
 
+// cleanupTimeout bounds the removal of temporary remote files, which runs even if the transfer was cancelled.
+const cleanupTimeout = 30 * time.Second
+
 // SCopyDir copy localDirPath to the remote dir specified by remoteDirPath,
 // Be aware that localDirPath and remoteDirPath should exists before SCopy.
 // At last, you should know, timeout is not reliable.
 func (sshConf *SSHConfig) SCopyDir(localDirPath, remoteDirPath string, timeout int, verbose bool) error {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	err := sshConf.SCopyDirContext(ctx, localDirPath, remoteDirPath, verbose)
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("SCopy timeout error: %s -> %s", RemoveTrailingSlash(localDirPath), RemoveTrailingSlash(remoteDirPath))
+	}
+	return err
+}
+
+// SCopyDirContext is like SCopyDir without timeout, the copy is aborted and ctx.Err() returned when ctx is done.
+func (sshConf *SSHConfig) SCopyDirContext(ctx context.Context, localDirPath, remoteDirPath string, verbose bool) error {
 	localDirPath = RemoveTrailingSlash(localDirPath)
 	remoteDirPath = RemoveTrailingSlash(remoteDirPath)
 
@@ -27,83 +42,99 @@ func (sshConf *SSHConfig) SCopyDir(localDirPath, remoteDirPath string, timeout i
 	localDirname := filepath.Base(localDirPath)
 	tgzName := fmt.Sprintf("%s_%s.tar.gz", Sha1(fmt.Sprintf("%s_%d", localDirPath, time.Now().UnixNano())), localDirname)
 	defer func() {
-		_, _ = Local("cd %s;rm -f %s", localDirParentPath, tgzName)
+		_, _ = LocalCommand(Command("cd", localDirParentPath).And("rm", "-f", tgzName))
 	}() // safe
 	defer func() {
-		_, _, _, _ = sshConf.Run(fmt.Sprintf("cd %s;rm -f %s", remoteDirPath, tgzName), timeout)
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		_, _, _ = sshConf.RunContext(cleanupCtx, Command("cd", remoteDirPath).And("rm", "-f", tgzName).String())
 	}() // safe
 
-	_, err := Local("cd %s;tar czf %s %s", localDirParentPath, tgzName, localDirname)
+	_, err := LocalCommand(Command("cd", localDirParentPath).And("tar", "czf", tgzName, localDirname))
 	if err != nil {
 		return fmt.Errorf("create tgz pack for (%s) error: %s", localDirPath, err.Error())
 	}
 
 	copyM := fmt.Sprintf("%s -> %s", localDirPath, remoteDirPath)
 	tgzPath := filepath.Join(localDirParentPath, tgzName)
-	if err = sshConf.SCopyFile(tgzPath, filepath.Join(remoteDirPath, tgzName)); err != nil {
+	if err = sshConf.SCopyFileContext(ctx, tgzPath, filepath.Join(remoteDirPath, tgzName)); err != nil {
 		if verbose {
 			fmt.Printf("upload %s error\n", copyM)
 		}
 		return err
 	}
 
-	isTimeout, err := sshConf.RtRun(fmt.Sprintf("cd %s;tar xf %s", remoteDirPath, tgzName), func(line string, lineType int) {
+	_, err = sshConf.execute(ctx, Command("tar", "xf", tgzName).String(), &RunOptions{Dir: remoteDirPath, Idempotent: true}, func(line string, lineType int) {
 		if verbose && TypeStderr == lineType {
 			fmt.Println(line)
 		}
-	}, timeout)
-
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return errors.New("extract tgz error: " + err.Error())
 	}
 
-	if isTimeout {
-		return fmt.Errorf("SCopy timeout error: %s", copyM)
-	}
-
 	return nil
 }
 
 // SCopyFile uploads srcFilePath to remote machine like native scp console app.
 // destFilePath should be an absolute file path including filename and cannot be a dir.
 func (sshConf *SSHConfig) SCopyFile(srcFilePath, destFilePath string) error {
-	return sshConf.Work(func(session *ssh.Session) error {
+	return sshConf.SCopyFileContext(context.Background(), srcFilePath, destFilePath)
+}
+
+// SCopyFileContext is like SCopyFile, the upload is aborted and ctx.Err() returned when ctx is done.
+func (sshConf *SSHConfig) SCopyFileContext(ctx context.Context, srcFilePath, destFilePath string) error {
+	return sshConf.retry(ctx, func(ctx context.Context) error {
+		return sshConf.scopyFile(ctx, srcFilePath, destFilePath)
+	})
+}
+
+func (sshConf *SSHConfig) scopyFile(ctx context.Context, srcFilePath, destFilePath string) error {
+	return sshConf.WorkContext(ctx, func(session *ssh.Session) error {
 		src, err := os.Open(srcFilePath)
 		if err != nil {
 			return err
 		}
+		defer Close(src)
 
 		stat, err := src.Stat()
 		if err != nil {
 			return err
 		}
 
-		var copyErr error
+		stdin, err := session.StdinPipe()
+		if err != nil {
+			return err
+		}
+		if err = session.Start(Command("scp", "-t", destFilePath).String()); err != nil {
+			return err
+		}
+
+		copyErr := make(chan error, 1)
 		go func() {
-			stdin, err := session.StdinPipe()
-			if err != nil {
-				copyErr = err
-				return
-			}
 			defer Close(stdin)
-			defer Close(src)
-			if _, err = fmt.Fprintf(stdin, "C%#o %d %s\n", stat.Mode().Perm(), stat.Size(), filepath.Base(destFilePath)); err != nil {
-				copyErr = fmt.Errorf("copy control char error: %s", err)
+			if _, err := fmt.Fprintf(stdin, "C%#o %d %s\n", stat.Mode().Perm(), stat.Size(), filepath.Base(destFilePath)); err != nil {
+				copyErr <- fmt.Errorf("copy control char error: %s", err)
+				return
 			}
 			if stat.Size() > 0 {
-				if _, err = io.Copy(stdin, src); err != nil {
-					copyErr = fmt.Errorf("copy %s error: %s", srcFilePath, err)
+				if _, err := io.Copy(stdin, src); err != nil {
+					copyErr <- fmt.Errorf("copy %s error: %s", srcFilePath, err)
 					return
 				}
 			}
-			_, copyErr = fmt.Fprint(stdin, "\x00")
+			_, err := fmt.Fprint(stdin, "\x00")
+			copyErr <- err
 		}()
 
-		if copyErr != nil {
-			return copyErr
+		err = session.Wait()
+		if cErr := <-copyErr; cErr != nil {
+			return cErr
 		}
-
-		return session.Run(fmt.Sprintf("scp -t %s", destFilePath))
+		return err
 	})
 }
 
@@ -111,84 +142,137 @@ func (sshConf *SSHConfig) SCopyFile(srcFilePath, destFilePath string) error {
 // Warning: to copy a local file, the remote path should contains the filename, however, to copy
 // a local dir, the remote path must be a dir into which the local path will be copied.
 func (sshConf *SSHConfig) SCopyM(pathMappings map[string]string, timeout int, verbose bool) error {
+	ctx, cancel := timeoutContext(timeout)
+	defer cancel()
+	err := sshConf.SCopyMContext(ctx, pathMappings, verbose)
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("SCopyM timeout error")
+	}
+	return err
+}
+
+// SCopyMContext is like SCopyM without timeout, the copies still running are aborted
+// when one of them fails or when ctx is done.
+func (sshConf *SSHConfig) SCopyMContext(ctx context.Context, pathMappings map[string]string, verbose bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	errCh := make(chan error, len(pathMappings))
-	doneCh := make(chan bool, len(pathMappings))
-	var err error
 	for localPath, remotePath := range pathMappings {
 		go func(local, remote string) {
-			if err == nil {
-				if err = sshConf.Scp(local, remote); err != nil {
-					errCh <- err
-				} else {
-					doneCh <- true
-				}
-			}
+			errCh <- sshConf.scp(ctx, local, remote, verbose)
 		}(localPath, remotePath)
 	}
 
-	if -1 == timeout {
-		// a long timeout simulate wait forever
-		timeout = 24 * 3600
-	}
-	timeoutChan := time.After(time.Duration(timeout) * time.Second)
-L:
 	for i := 0; i < len(pathMappings); i++ {
-		select {
-		case <-doneCh:
-		case err = <-errCh:
-			break L
-		case <-timeoutChan:
-			err = errors.New("SCopyM timeout error")
-			break L
+		if err := <-errCh; err != nil {
+			return err
 		}
 	}
-	return err
+	return nil
+}
+
+// timeoutContext returns a context expiring after timeout seconds, zero or less means no timeout.
+func timeoutContext(timeout int) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), seconds(timeout))
 }
 
 // Work a helper method to build a ssh connection.
 func (sshConf *SSHConfig) Work(fn func(session *ssh.Session) error) error {
-	session, err := sshConf.connect()
+	return sshConf.WorkContext(context.Background(), fn)
+}
+
+// WorkContext is like Work, the session is closed as soon as ctx is done and ctx.Err() is returned.
+func (sshConf *SSHConfig) WorkContext(ctx context.Context, fn func(session *ssh.Session) error) error {
+	session, err := sshConf.connect(ctx)
 	if err != nil {
 		return err
 	}
-	defer Close(session)
-	return fn(session)
+	defer session.release()
+	defer closeOnDone(ctx, func() { _ = session.release() })()
+
+	err = fn(session.Session)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		if lost := session.lostErr(); lost != nil {
+			return lost
+		}
+	}
+	return err
 }
 
 // SafeScp first copy localPath to remote /tmp path, then move tmp file to remotePath if upload successfully.
 func (sshConf *SSHConfig) SafeScp(localPath, remotePath string) error {
+	return sshConf.SafeScpContext(context.Background(), localPath, remotePath)
+}
+
+// SafeScpContext is like SafeScp, the copy is aborted and ctx.Err() returned when ctx is done.
+func (sshConf *SSHConfig) SafeScpContext(ctx context.Context, localPath, remotePath string) error {
 	if goutils.IsDir(localPath) {
-		return sshConf.SCopyDir(localPath, remotePath, -1, false)
+		return sshConf.SCopyDirContext(ctx, localPath, remotePath, false)
 	}
 
 	remoteTmpName := Sha1(fmt.Sprintf("%s_%d", localPath, time.Now().UnixNano()))
 	destTmpPath := filepath.Join("/tmp", remoteTmpName)
-	err := sshConf.SCopyFile(localPath, destTmpPath)
+	err := sshConf.SCopyFileContext(ctx, localPath, destTmpPath)
 	defer func() {
-		_, _, _, _ = sshConf.Run(fmt.Sprintf("rm -f /tmp/%s", remoteTmpName), -1) // safe
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		_, _, _ = sshConf.RunContext(cleanupCtx, Command("rm", "-f", destTmpPath).String()) // safe
 	}()
 
 	if err != nil {
 		return err
 	}
-	_, _, _, err = sshConf.Run(fmt.Sprintf("mv %s %s", destTmpPath, remotePath), -1) // safe
+	_, _, err = sshConf.RunContext(ctx, Command("mv", destTmpPath, remotePath).String()) // safe
 	return err
 }
 
 // DownloadF is short for download file, both the remote path and local path should be the absolute path.
 func (sshConf *SSHConfig) DownloadF(remotePath, localPath string) error {
-	cli, err := sshConf.Cli()
-	if err != nil {
+	return sshConf.DownloadFContext(context.Background(), remotePath, localPath)
+}
+
+// DownloadFContext is like DownloadF, the download is aborted and ctx.Err() returned when ctx is done.
+func (sshConf *SSHConfig) DownloadFContext(ctx context.Context, remotePath, localPath string) error {
+	if err := prepareDownload(localPath); err != nil {
 		return err
 	}
-	defer Close(cli)
+	return sshConf.retry(ctx, func(ctx context.Context) error {
+		return sshConf.WorkContext(ctx, func(session *ssh.Session) error {
+			client, err := newSftpClient(session)
+			if err != nil {
+				return err
+			}
+			defer Close(client)
+			return download(client, remotePath, localPath)
+		})
+	})
+}
 
-	client, err := sftp.NewClient(cli)
+// newSftpClient starts the sftp subsystem on session.
+func newSftpClient(session *ssh.Session) (*sftp.Client, error) {
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, err
+	}
+	pw, err := session.StdinPipe()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	pr, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
 	}
-	defer Close(client)
+	return sftp.NewClientPipe(pr, pw)
+}
 
+// prepareDownload checks localPath can be downloaded to, asking before overriding an existing file.
+func prepareDownload(localPath string) error {
 	if goutils.IsDir(localPath) {
 		return fmt.Errorf("%s is a dir", localPath)
 	}
@@ -203,7 +287,10 @@ func (sshConf *SSHConfig) DownloadF(remotePath, localPath string) error {
 	if err := os.MkdirAll(localDir, 0666); err != nil {
 		return fmt.Errorf("mkdir for localpath: %s failed", localPath)
 	}
+	return nil
+}
 
+func download(client *sftp.Client, remotePath, localPath string) error {
 	// create destination file
 	dstFile, err := os.Create(localPath)
 	if err != nil {
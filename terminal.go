@@ -0,0 +1,50 @@
+package easyssh
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// Interactive opens a login shell on the remote host, attached to the local terminal like ssh does.
+// The local terminal is put in raw mode until the shell exits, and its window size is kept in sync.
+func (sshConf *SSHConfig) Interactive() error {
+	return sshConf.InteractiveContext(context.Background())
+}
+
+// InteractiveContext is like Interactive, the shell is closed if ctx is done before it exits.
+func (sshConf *SSHConfig) InteractiveContext(ctx context.Context) error {
+	return sshConf.interactive(ctx, os.Stdin, os.Stdout)
+}
+
+func (sshConf *SSHConfig) interactive(ctx context.Context, stdin, stdout *os.File) error {
+	pty := &PTY{Term: os.Getenv("TERM")}
+	stdinFd, stdoutFd := int(stdin.Fd()), int(stdout.Fd())
+	if term.IsTerminal(stdoutFd) {
+		pty.Width, pty.Height, _ = term.GetSize(stdoutFd)
+	}
+	if term.IsTerminal(stdinFd) {
+		state, err := term.MakeRaw(stdinFd)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = term.Restore(stdinFd, state) }()
+	}
+
+	// the input typed once the shell exits is left to the local process.
+	reader := newStdinReader(stdin)
+	defer reader.stop()
+	p, err := sshConf.start(ctx, "", &RunOptions{PTY: pty, Stdin: reader, Stdout: stdout, Stderr: os.Stderr})
+	if err != nil {
+		return err
+	}
+	if term.IsTerminal(stdoutFd) {
+		stop := watchWindowSize(stdoutFd, func(width, height int) {
+			_ = p.session.WindowChange(height, width)
+		})
+		defer stop()
+	}
+	_, err = p.wait()
+	return err
+}
@@ -0,0 +1,77 @@
+package easyssh
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestInteractive(t *testing.T) {
+	s := startTestServer(t)
+	defer s.close()
+	sshConf := s.sshConfig()
+	sshConf.KillGracePeriod = 50 * time.Millisecond
+	if term, ok := os.LookupEnv("TERM"); ok {
+		defer os.Setenv("TERM", term)
+		os.Unsetenv("TERM")
+	}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdinR.Close()
+	defer stdinW.Close()
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdoutR.Close()
+	defer stdoutW.Close()
+
+	// the login shell of the test server copies its input.
+	if _, err := stdinW.Write([]byte("hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := sshConf.interactive(ctx, stdinR, stdoutW); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	out := make([]byte, 3)
+	if _, err := io.ReadFull(stdoutR, out); err != nil || string(out) != "hi\n" {
+		t.Errorf("unexpected output: %q %v", out, err)
+	}
+
+	s.mu.Lock()
+	ptys := s.ptys
+	s.mu.Unlock()
+	want := testPTY{Term: "xterm", Width: 80, Height: 24, Modes: ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}}
+	if len(ptys) != 1 || !reflect.DeepEqual(ptys[0], want) {
+		t.Errorf("unexpected pty-req: %+v", ptys)
+	}
+
+	// the input typed once the shell is over is not consumed.
+	if _, err := stdinW.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan string, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := stdinR.Read(b)
+		read <- string(b[:n])
+	}()
+	select {
+	case got := <-read:
+		if got != "x" {
+			t.Errorf("unexpected input: %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("the input was consumed")
+	}
+}
@@ -0,0 +1,90 @@
+package easyssh
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Parse returns the SSHConfig of target, which is either an ssh://[user[:password]@]host[:port] URL or
+// a [user[:password]@]host[:port] string. IPv6 addresses with a port are written in brackets, like [fe80::1]:22.
+func Parse(target string) (*SSHConfig, error) {
+	if strings.HasPrefix(target, "ssh://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Path != "" && u.Path != "/" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("unexpected path or query in ssh url: %s", target)
+		}
+		if u.Hostname() == "" {
+			return nil, fmt.Errorf("missing host in ssh url: %s", target)
+		}
+		sshConf := &SSHConfig{Server: u.Hostname(), Port: u.Port()}
+		if u.User != nil {
+			sshConf.User = u.User.Username()
+			sshConf.Password, _ = u.User.Password()
+		}
+		return sshConf, nil
+	}
+
+	sshConf := &SSHConfig{}
+	hostPort := target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		userInfo := target[:i]
+		hostPort = target[i+1:]
+		if j := strings.Index(userInfo, ":"); j >= 0 {
+			sshConf.User, sshConf.Password = userInfo[:j], userInfo[j+1:]
+		} else {
+			sshConf.User = userInfo
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(hostPort, "["):
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			// [fe80::1] without port
+			if !strings.HasSuffix(hostPort, "]") {
+				return nil, fmt.Errorf("invalid ssh target %s: %w", target, err)
+			}
+			host, port = hostPort[1:len(hostPort)-1], ""
+		}
+		sshConf.Server, sshConf.Port = host, port
+	case strings.Count(hostPort, ":") == 1:
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh target %s: %w", target, err)
+		}
+		sshConf.Server, sshConf.Port = host, port
+	default:
+		// a host name, or an IPv6 address without port
+		sshConf.Server = hostPort
+	}
+	if sshConf.Server == "" {
+		return nil, fmt.Errorf("missing host in ssh target: %s", target)
+	}
+	return sshConf, nil
+}
+
+// String returns the ssh:// URL of sshConf, the password is redacted.
+func (sshConf *SSHConfig) String() string {
+	u := &url.URL{Scheme: "ssh", Host: sshConf.host()}
+	if sshConf.Port != "" {
+		u.Host = net.JoinHostPort(u.Host, sshConf.Port)
+	} else if strings.Contains(u.Host, ":") {
+		u.Host = "[" + u.Host + "]"
+	}
+	if sshConf.Password != "" {
+		u.User = url.UserPassword(sshConf.User, "xxxxx")
+	} else if sshConf.User != "" {
+		u.User = url.User(sshConf.User)
+	}
+	return u.String()
+}
+
+// host returns Server, without the brackets of IPv6 addresses.
+func (sshConf *SSHConfig) host() string {
+	return strings.TrimSuffix(strings.TrimPrefix(sshConf.Server, "["), "]")
+}